@@ -0,0 +1,73 @@
+package workflow
+
+import (
+	"reflect"
+	"sort"
+)
+
+// GraphDiff is the structural difference between two graphs, by node key
+type GraphDiff struct {
+	Added   []string              `json:"added"`
+	Removed []string              `json:"removed"`
+	Changed map[string]NodeChange `json:"changed"`
+}
+
+// NodeChange is the definition of a node before and after
+type NodeChange struct {
+	Before *FlowNode `json:"before"`
+	After  *FlowNode `json:"after"`
+}
+
+// Diff compare the definition of the nodes of two graphs, the runtime state is ignored
+func Diff(before, after map[string]*FlowNode) GraphDiff {
+	d := GraphDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Changed: make(map[string]NodeChange),
+	}
+	for key, a := range before {
+		b, exist := after[key]
+		if !exist {
+			d.Removed = append(d.Removed, key)
+			continue
+		}
+		if !sameDefinition(a, b) {
+			d.Changed[key] = NodeChange{Before: a, After: b}
+		}
+	}
+	for key := range after {
+		if _, exist := before[key]; !exist {
+			d.Added = append(d.Added, key)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	return d
+}
+
+// IsEmpty return true if the graphs are the same
+func (d GraphDiff) IsEmpty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+func sameDefinition(a, b *FlowNode) bool {
+	nilIfEmpty := func(l []string) []string {
+		if len(l) == 0 {
+			return nil
+		}
+		return l
+	}
+	if a.ID != b.ID || a.Name != b.Name || a.Type != b.Type || a.Operator != b.Operator {
+		return false
+	}
+	if !reflect.DeepEqual(nilIfEmpty(a.Inputs), nilIfEmpty(b.Inputs)) ||
+		!reflect.DeepEqual(nilIfEmpty(a.Values), nilIfEmpty(b.Values)) ||
+		!reflect.DeepEqual(nilIfEmpty(a.Condition), nilIfEmpty(b.Condition)) {
+		return false
+	}
+	// the value of a constant is part of the definition
+	if a.Operator == "const" && !reflect.DeepEqual(a.ComputedValue, b.ComputedValue) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,36 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := Diff(graph.Flow, graph.Clone().Flow); !d.IsEmpty() {
+		t.Errorf("a clone must not differ: %+v", d)
+	}
+
+	next := graph.Clone()
+	next.Flow["const0"].ComputedValue = 0.9
+	next.Flow["op5"].Condition = []string{"0:.5", ".5:1"}
+	next.Flow["op5"].Values = []string{"slow", "fast"}
+	delete(next.Flow, "webhook")
+	next.Flow["const1"] = &FlowNode{Operator: "const", Type: "float", ComputedValue: 1.0}
+
+	d := Diff(graph.Flow, next.Flow)
+	if len(d.Added) != 1 || d.Added[0] != "const1" {
+		t.Errorf("wrong added nodes %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != "webhook" {
+		t.Errorf("wrong removed nodes %v", d.Removed)
+	}
+	if _, exist := d.Changed["const0"]; !exist || len(d.Changed) != 2 {
+		t.Errorf("wrong changed nodes %v", d.Changed)
+	}
+}
@@ -0,0 +1,146 @@
+package workflow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNoExplanation is returned by Explain when the output has not changed yet
+var ErrNoExplanation = errors.New("no explanation of the output")
+
+// Explanation is the lineage of the last change of an output
+type Explanation struct {
+	Output   string `json:"output"`
+	SensorID string `json:"sensor_id"`
+	Name     string `json:"name"`
+	Old      Value  `json:"old"`
+	New      Value  `json:"new"`
+	Rev      uint64 `json:"rev"`
+
+	// Inputs changed since the previous Compute which lead to the output
+	Inputs []InputChange `json:"inputs"`
+	// Path is the value of the intermediate nodes between the changed inputs and the output
+	Path map[string]Value `json:"path"`
+}
+
+// InputChange is a changed input node
+type InputChange struct {
+	Node      string    `json:"node"`
+	SensorID  string    `json:"sensor_id"`
+	Name      string    `json:"name"`
+	Old       Value     `json:"old"`
+	New       Value     `json:"new"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Explain return the lineage of the last change of the output.
+// The output is found by its node key, or by its sensor id or its name when a single output node match.
+func (g *FlowGraph) Explain(output string) (Explanation, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	key := output
+	if _, exist := g.Flow[key]; !exist {
+		var matches []string
+		for _, out := range g.Outputs {
+			if out.ID == output || out.Name == output {
+				matches = append(matches, out.key)
+			}
+		}
+		if len(matches) > 1 {
+			sort.Strings(matches)
+			return Explanation{}, fmt.Errorf("ambiguous output '%s' match the nodes %s", output, strings.Join(matches, ", "))
+		}
+		if len(matches) == 1 {
+			key = matches[0]
+		}
+	}
+	e, exist := g.explanations[key]
+	if !exist {
+		return Explanation{}, ErrNoExplanation
+	}
+	return e, nil
+}
+
+// OutputExplanations return the explanation of the outputs of the sensor changed by the last Compute, by node key
+func (g *FlowGraph) OutputExplanations(sid string) map[string]Explanation {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	res := make(map[string]Explanation)
+	for _, out := range g.Outputs {
+		if out.ID != sid || !out.changed {
+			continue
+		}
+		if e, exist := g.explanations[out.key]; exist {
+			res[out.key] = e
+		}
+	}
+	return res
+}
+
+// explain record the lineage of the outputs changed by the Compute, g.mu must be locked
+func (g *FlowGraph) explain() {
+	var changed []Explanation
+	for _, out := range g.Outputs {
+		if !out.changed {
+			continue
+		}
+		e := Explanation{
+			Output:   out.key,
+			SensorID: out.ID,
+			Name:     out.Name,
+			Old:      out.prevValue,
+			New:      out.ComputedValue,
+			Rev:      g.rev,
+			Inputs:   []InputChange{},
+			Path:     make(map[string]Value),
+		}
+		g.lineage(out, &e, make(map[*FlowNode]bool))
+		sort.Slice(e.Inputs, func(i, j int) bool { return e.Inputs[i].Node < e.Inputs[j].Node })
+		changed = append(changed, e)
+	}
+	if len(changed) == 0 {
+		return
+	}
+
+	if g.explanations == nil {
+		g.explanations = make(map[string]Explanation)
+	}
+	for _, e := range changed {
+		g.explanations[e.Output] = e
+	}
+}
+
+// lineage walk the graph upstream from the node and return true if a changed input lead to it.
+// seen memoize the result of each visited node.
+func (g *FlowGraph) lineage(node *FlowNode, e *Explanation, seen map[*FlowNode]bool) bool {
+	if leads, visited := seen[node]; visited {
+		return leads
+	}
+	leads := false
+	if node.Operator == "input" {
+		leads = node.rev > g.computedRev && node.prevValue != node.ComputedValue
+		if leads {
+			e.Inputs = append(e.Inputs, InputChange{
+				Node:      node.key,
+				SensorID:  node.ID,
+				Name:      node.Name,
+				Old:       node.prevValue,
+				New:       node.ComputedValue,
+				ChangedAt: node.lastChanged,
+			})
+		}
+	}
+	for _, key := range node.Inputs {
+		if g.lineage(g.Flow[key], e, seen) {
+			leads = true
+		}
+	}
+	if leads && node.Operator != "input" && node.Operator != "output" {
+		e.Path[node.key] = node.ComputedValue
+	}
+	seen[node] = leads
+	return leads
+}
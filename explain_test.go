@@ -0,0 +1,68 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestExplain(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = graph.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid := "1377959e-97ce-46c1-9715-22c34bb9afbe"
+	_, err = graph.SendInput("", sid, time.Unix(1, 0), map[string]interface{}{"ramusage": 1.0, "loadaverage": 0.2, "ram": 4.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Compute()
+
+	if _, err := graph.Explain("unknown"); err != ErrNoExplanation {
+		t.Errorf("an unknown output should not be explained, got %v", err)
+	}
+	e, err := graph.Explain("output1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Old != nil || e.New != "slow" || len(e.Inputs) != 3 {
+		t.Errorf("wrong first explanation %+v", e)
+	}
+
+	// only the load average change and set the windmill on fire
+	_, err = graph.SendInput("", sid, time.Unix(2, 0), map[string]interface{}{"ramusage": 1.0, "loadaverage": 0.9, "ram": 4.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Compute()
+
+	e, err = graph.Explain("windmill_onfire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Old != false || e.New != true {
+		t.Errorf("wrong output change %v -> %v", e.Old, e.New)
+	}
+	if len(e.Inputs) != 1 || e.Inputs[0].Node != "input1" || e.Inputs[0].Old != 0.2 || e.Inputs[0].New != 0.9 {
+		t.Errorf("wrong changed inputs %+v", e.Inputs)
+	}
+	if _, exist := e.Path["op1"]; !exist || len(e.Path) != 2 {
+		t.Errorf("wrong path %v", e.Path)
+	}
+
+	// both outputs belong to the same sensor
+	if _, err := graph.Explain("1949f63d-5e40-45bb-9d31-13ab52b5e92a"); err == nil || err == ErrNoExplanation {
+		t.Errorf("the sensor id should be ambiguous, got %v", err)
+	}
+
+	outs := graph.OutputExplanations("1949f63d-5e40-45bb-9d31-13ab52b5e92a")
+	if _, exist := outs["output0"]; !exist || len(outs) != 2 {
+		t.Errorf("expected both outputs explained by node key, got %v", outs)
+	}
+}
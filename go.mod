@@ -3,10 +3,19 @@ module github.com/fredericalix/yic_workflow-engine
 go 1.12
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.3.3
+	github.com/eclipse/paho.mqtt.golang v1.2.0
 	github.com/fredericalix/yic_auth v0.0.0-20191011145937-c426ccc2af40
 	github.com/gofrs/uuid v3.2.0+incompatible
+	github.com/gorilla/websocket v1.4.1
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/lib/pq v1.2.0
+	github.com/prometheus/client_golang v1.1.0
 	github.com/spf13/viper v1.4.0
 	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 )
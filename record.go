@@ -0,0 +1,218 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordedMessage is a sensor message received or published by a workflow
+type RecordedMessage struct {
+	RoutingKey string    `json:"routing_key"`
+	Body       string    `json:"body"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// Recording of the sensor traffic of a workflow, in the order of arrival
+type Recording struct {
+	Inputs  []RecordedMessage `json:"inputs"`
+	Outputs []RecordedMessage `json:"outputs"`
+}
+
+// Recorder keep the last received and published messages of a workflow.
+// The inputs and the outputs are kept in two ring buffers of the same size.
+// It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	inputs  ring
+	outputs ring
+}
+
+// NewRecorder keeping at most size inputs and size outputs
+func NewRecorder(size int) *Recorder {
+	if size < 1 {
+		size = 1
+	}
+	return &Recorder{
+		inputs:  ring{buf: make([]RecordedMessage, 0, size)},
+		outputs: ring{buf: make([]RecordedMessage, 0, size)},
+	}
+}
+
+// RecordInput add a received sensor message
+func (r *Recorder) RecordInput(routingKey string, body []byte, ts time.Time) {
+	r.mu.Lock()
+	r.inputs.add(RecordedMessage{RoutingKey: routingKey, Body: string(body), Timestamp: ts})
+	r.mu.Unlock()
+}
+
+// RecordOutput add a published output message
+func (r *Recorder) RecordOutput(routingKey string, body []byte, ts time.Time) {
+	r.mu.Lock()
+	r.outputs.add(RecordedMessage{RoutingKey: routingKey, Body: string(body), Timestamp: ts})
+	r.mu.Unlock()
+}
+
+// Recording return a copy of the recorded messages
+func (r *Recorder) Recording() Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Recording{
+		Inputs:  r.inputs.list(),
+		Outputs: r.outputs.list(),
+	}
+}
+
+type ring struct {
+	buf  []RecordedMessage
+	next int
+}
+
+func (r *ring) add(m RecordedMessage) {
+	if len(r.buf) < cap(r.buf) {
+		r.buf = append(r.buf, m)
+		return
+	}
+	r.buf[r.next] = m
+	r.next = (r.next + 1) % len(r.buf)
+}
+
+func (r *ring) list() []RecordedMessage {
+	l := make([]RecordedMessage, 0, len(r.buf))
+	l = append(l, r.buf[r.next:]...)
+	return append(l, r.buf[:r.next]...)
+}
+
+// DecodeSensorMessage extract the account id, the sensor id, the creation time and the data
+// of a message from the sensors exchange
+func DecodeSensorMessage(routingKey string, body []byte) (aid, sid string, createdAt time.Time, data map[string]interface{}, err error) {
+	rk := strings.Split(routingKey, ".")
+	if len(rk) < 2 {
+		return "", "", createdAt, nil, fmt.Errorf("invalid routing key '%s'", routingKey)
+	}
+	aid, sid = rk[0], rk[1]
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return aid, sid, createdAt, nil, err
+	}
+	msgTime, ok := data["created_at"].(string)
+	if !ok {
+		return aid, sid, createdAt, data, fmt.Errorf("missing created_at field")
+	}
+	createdAt, err = time.Parse(time.RFC3339Nano, msgTime)
+	if err != nil {
+		return aid, sid, createdAt, data, fmt.Errorf("created_at parsing error: %v", err)
+	}
+	return aid, sid, createdAt, data, nil
+}
+
+// ReplayResult is the output stream of a replay and its differences with the recorded one
+type ReplayResult struct {
+	Outputs []RecordedMessage `json:"outputs"`
+	Diff    []OutputDiff      `json:"diff"`
+	Errors  []string          `json:"errors,omitempty"`
+}
+
+// OutputDiff is a difference between the recorded and the replayed output of a sensor.
+// Index is the position of the message in the stream of this routing key.
+// A missing message is nil.
+type OutputDiff struct {
+	RoutingKey string                 `json:"routing_key"`
+	Index      int                    `json:"index"`
+	Recorded   map[string]interface{} `json:"recorded"`
+	Replayed   map[string]interface{} `json:"replayed"`
+}
+
+// Replay feed the recorded inputs through the graph and compare the produced output
+// with the recorded outputs. The created_at field is ignored in the comparison.
+// The graph is built if needed and should start from the state it had at the start of the recording,
+// otherwise the first outputs will likely differ.
+func Replay(g *FlowGraph, rec Recording) (ReplayResult, error) {
+	res := ReplayResult{Outputs: []RecordedMessage{}, Diff: []OutputDiff{}}
+	if g.Inputs == nil {
+		if err := g.Build(); err != nil {
+			return res, err
+		}
+	}
+
+	for i, in := range rec.Inputs {
+		aid, sid, createdAt, data, err := DecodeSensorMessage(in.RoutingKey, []byte(in.Body))
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("input %d: %v", i, err))
+			continue
+		}
+		recompute, err := g.SendInput(aid, sid, createdAt, data)
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("input %d: %v", i, err))
+			continue
+		}
+		if !recompute {
+			continue
+		}
+		if err := g.safeCompute(); err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("input %d: %v", i, err))
+			continue
+		}
+		for outSID, out := range g.OutputMessages() {
+			out["created_at"] = in.Timestamp.Format(time.RFC3339Nano)
+			body, err := json.Marshal(out)
+			if err != nil {
+				res.Errors = append(res.Errors, fmt.Sprintf("input %d: %v", i, err))
+				continue
+			}
+			res.Outputs = append(res.Outputs, RecordedMessage{RoutingKey: aid + "." + outSID, Body: string(body), Timestamp: in.Timestamp})
+		}
+	}
+
+	res.Diff = diffOutputs(rec.Outputs, res.Outputs)
+	return res, nil
+}
+
+// diffOutputs compare two output streams routing key by routing key
+func diffOutputs(recorded, replayed []RecordedMessage) []OutputDiff {
+	streams := func(msgs []RecordedMessage) (map[string][]map[string]interface{}, []string) {
+		s := make(map[string][]map[string]interface{})
+		var keys []string
+		for _, m := range msgs {
+			var body map[string]interface{}
+			if err := json.Unmarshal([]byte(m.Body), &body); err != nil {
+				body = map[string]interface{}{"body": m.Body}
+			}
+			delete(body, "created_at")
+			if _, exist := s[m.RoutingKey]; !exist {
+				keys = append(keys, m.RoutingKey)
+			}
+			s[m.RoutingKey] = append(s[m.RoutingKey], body)
+		}
+		return s, keys
+	}
+	rec, keys := streams(recorded)
+	rep, repKeys := streams(replayed)
+	for _, k := range repKeys {
+		if _, exist := rec[k]; !exist {
+			keys = append(keys, k)
+		}
+	}
+
+	diff := []OutputDiff{}
+	for _, k := range keys {
+		a, b := rec[k], rep[k]
+		for i := 0; i < len(a) || i < len(b); i++ {
+			var ra, rb map[string]interface{}
+			if i < len(a) {
+				ra = a[i]
+			}
+			if i < len(b) {
+				rb = b[i]
+			}
+			if !reflect.DeepEqual(ra, rb) {
+				diff = append(diff, OutputDiff{RoutingKey: k, Index: i, Recorded: ra, Replayed: rb})
+			}
+		}
+	}
+	return diff
+}
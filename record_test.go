@@ -0,0 +1,65 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRecorderRing(t *testing.T) {
+	rec := NewRecorder(3)
+	for i := 0; i < 5; i++ {
+		rec.RecordInput(fmt.Sprintf("a.%d", i), []byte("{}"), time.Unix(int64(i), 0))
+	}
+	inputs := rec.Recording().Inputs
+	if len(inputs) != 3 {
+		t.Fatalf("expected 3 inputs, got %d", len(inputs))
+	}
+	for i, in := range inputs {
+		if in.RoutingKey != fmt.Sprintf("a.%d", i+2) {
+			t.Errorf("wrong order at %d: %v", i, in.RoutingKey)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aid := "fe8927e9-a02a-416a-8928-c3a86dae4c61"
+	in := aid + ".1377959e-97ce-46c1-9715-22c34bb9afbe"
+	out := aid + ".1949f63d-5e40-45bb-9d31-13ab52b5e92a"
+	rec := Recording{
+		Inputs: []RecordedMessage{
+			{RoutingKey: in, Body: `{"created_at":"2019-01-01T00:00:01Z","ramusage":1.0,"loadaverage":0.2,"ram":4.0}`},
+			{RoutingKey: in, Body: `not json`},
+			{RoutingKey: in, Body: `{"created_at":"2019-01-01T00:00:02Z","loadaverage":0.9}`},
+		},
+		Outputs: []RecordedMessage{
+			{RoutingKey: out, Body: `{"id":"1949f63d-5e40-45bb-9d31-13ab52b5e92a","created_at":"2019-01-01T00:00:01Z","windmill_onfire":false,"windmill_propeler_speed":"slow"}`},
+			{RoutingKey: out, Body: `{"id":"1949f63d-5e40-45bb-9d31-13ab52b5e92a","created_at":"2019-01-01T00:00:02Z","windmill_onfire":false,"windmill_propeler_speed":"fast"}`},
+		},
+	}
+
+	res, err := Replay(&graph, rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Outputs) != 2 {
+		t.Fatalf("expected 2 outputs, got %v", res.Outputs)
+	}
+	if len(res.Errors) != 1 {
+		t.Errorf("expected 1 error for the invalid message, got %v", res.Errors)
+	}
+	if len(res.Diff) != 1 {
+		t.Fatalf("expected 1 difference, got %+v", res.Diff)
+	}
+	d := res.Diff[0]
+	if d.Index != 1 || d.Recorded["windmill_onfire"] != false || d.Replayed["windmill_onfire"] != true {
+		t.Errorf("wrong difference %+v", d)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cloudEventsContentType is the content type of the structured CloudEvents
+const cloudEventsContentType = "application/cloudevents+json"
+
+// outputEventType is the CloudEvents type of the output messages
+const outputEventType = "com.yic.workflow.output"
+
+// the prefixes of the CloudEvents attributes in the headers of the binary mode,
+// the first one is used to publish
+var cloudEventsPrefixes = []string{"cloudEvents_", "cloudEvents:"}
+
+// cloudEvent is a CloudEvents 1.0 in structured mode
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// eventAttribute return the CloudEvents attribute from the headers of the binary mode
+func eventAttribute(headers map[string]interface{}, name string) (string, bool) {
+	for _, prefix := range cloudEventsPrefixes {
+		if v, ok := headers[prefix+name].(string); ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// decodeCloudEvent return the sensor message carried by a CloudEvents in binary or structured mode.
+// The created_at of the data is set from the time of the event if missing.
+// It returns false if the message is not a CloudEvents.
+func decodeCloudEvent(m Message) (Message, bool, error) {
+	if _, binary := eventAttribute(m.Headers, "specversion"); binary {
+		if t, ok := eventAttribute(m.Headers, "time"); ok {
+			m.Body = withEventTime(m.Body, t)
+		}
+		return m, true, nil
+	}
+
+	structured := strings.HasPrefix(m.ContentType, cloudEventsContentType)
+	if !structured && !bytes.Contains(m.Body, []byte(`"specversion"`)) {
+		return m, false, nil
+	}
+	var e cloudEvent
+	if err := json.Unmarshal(m.Body, &e); err != nil || e.SpecVersion == "" {
+		if structured {
+			return m, false, fmt.Errorf("invalid CloudEvents: %v", err)
+		}
+		return m, false, nil
+	}
+	data := []byte(e.Data)
+	if e.DataBase64 != "" {
+		var err error
+		data, err = base64.StdEncoding.DecodeString(e.DataBase64)
+		if err != nil {
+			return m, false, fmt.Errorf("invalid CloudEvents data_base64: %v", err)
+		}
+	}
+	m.Body = withEventTime(data, e.Time)
+	m.ContentType = e.DataContentType
+	if m.ContentType == "" {
+		m.ContentType = "application/json"
+	}
+	return m, true, nil
+}
+
+// withEventTime set the created_at of the data to the time of the event if missing
+func withEventTime(data []byte, eventTime string) []byte {
+	t, err := time.Parse(time.RFC3339Nano, eventTime)
+	if err != nil {
+		return data
+	}
+	return withCreatedAt(data, t)
+}
+
+// encodeCloudEvent encode the output message of the workflow as a CloudEvents in binary or structured mode.
+// The source is the workflow, the subject is the output sensor.
+func encodeCloudEvent(m Message, mode, eventID, aid, wid, sid, eventTime string) (Message, error) {
+	source := fmt.Sprintf("/accounts/%s/workflows/%s", aid, wid)
+	switch mode {
+	case "binary":
+		headers := make(map[string]interface{}, len(m.Headers)+6)
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+		prefix := cloudEventsPrefixes[0]
+		headers[prefix+"specversion"] = "1.0"
+		headers[prefix+"id"] = eventID
+		headers[prefix+"source"] = source
+		headers[prefix+"type"] = outputEventType
+		headers[prefix+"subject"] = sid
+		headers[prefix+"time"] = eventTime
+		// the distributed tracing extension
+		for _, name := range []string{"traceparent", "tracestate"} {
+			if v, ok := m.Headers[name]; ok {
+				headers[prefix+name] = v
+			}
+		}
+		m.Headers = headers
+		return m, nil
+
+	case "structured":
+		body, err := json.Marshal(cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              eventID,
+			Source:          source,
+			Type:            outputEventType,
+			Subject:         sid,
+			Time:            eventTime,
+			DataContentType: m.ContentType,
+			Data:            json.RawMessage(m.Body),
+		})
+		if err != nil {
+			return m, err
+		}
+		m.Body = body
+		m.ContentType = cloudEventsContentType + "; charset=utf-8"
+		return m, nil
+	}
+	return m, nil
+}
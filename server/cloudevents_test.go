@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCloudEvents(t *testing.T) {
+	out := Message{
+		RoutingKey:  "aid.sid",
+		Headers:     map[string]interface{}{"timestamp": "2019-10-01T12:00:00Z", "traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		ContentType: "application/json",
+		Body:        []byte(`{"id":"sid","hot":true}`),
+	}
+	for _, mode := range []string{"binary", "structured"} {
+		m, err := encodeCloudEvent(out, mode, "e1", "aid", "wid", "sid", "2019-10-01T12:00:00Z")
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch mode {
+		case "binary":
+			if string(m.Body) != string(out.Body) || m.Headers["cloudEvents_source"] != "/accounts/aid/workflows/wid" ||
+				m.Headers["cloudEvents_subject"] != "sid" || m.Headers["timestamp"] == nil ||
+				m.Headers["cloudEvents_traceparent"] != out.Headers["traceparent"] {
+				t.Errorf("wrong binary event %s %v", m.Body, m.Headers)
+			}
+		case "structured":
+			var e cloudEvent
+			if err := json.Unmarshal(m.Body, &e); err != nil {
+				t.Fatal(err)
+			}
+			if e.SpecVersion != "1.0" || e.ID != "e1" || e.Type != outputEventType || string(e.Data) != string(out.Body) {
+				t.Errorf("wrong structured event %s", m.Body)
+			}
+		}
+
+		// the decoded event carry the data with the created_at of the event
+		d, isEvent, err := decodeCloudEvent(m)
+		if err != nil || !isEvent {
+			t.Fatalf("%s: not decoded %v", mode, err)
+		}
+		var data map[string]interface{}
+		if err := json.Unmarshal(d.Body, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["hot"] != true || data["created_at"] != "2019-10-01T12:00:00Z" || d.ContentType != "application/json" {
+			t.Errorf("%s: wrong decoded event %s %s", mode, d.Body, d.ContentType)
+		}
+	}
+
+	// the data_base64 and the old binary prefix
+	d, isEvent, err := decodeCloudEvent(Message{
+		ContentType: cloudEventsContentType,
+		Body:        []byte(`{"specversion":"1.0","id":"1","source":"s","type":"t","data_base64":"eyJ2IjoxfQ=="}`),
+	})
+	if err != nil || !isEvent || string(d.Body) != `{"v":1}` {
+		t.Errorf("wrong data_base64 %s %v", d.Body, err)
+	}
+	d, isEvent, _ = decodeCloudEvent(Message{
+		Headers: map[string]interface{}{"cloudEvents:specversion": "1.0", "cloudEvents:time": "2019-10-01T12:00:00Z"},
+		Body:    []byte(`{"created_at":"2019-01-01T00:00:00Z","v":1}`),
+	})
+	if !isEvent || string(d.Body) != `{"created_at":"2019-01-01T00:00:00Z","v":1}` {
+		t.Errorf("the created_at of the data should be kept, got %s", d.Body)
+	}
+
+	// the plain sensor messages and the invalid structured events
+	plain := Message{ContentType: "application/json", Body: []byte(`{"created_at":"2019-10-01T12:00:00Z","v":1}`)}
+	if _, isEvent, err := decodeCloudEvent(plain); isEvent || err != nil {
+		t.Errorf("a plain message is not an event: %v", err)
+	}
+	if _, _, err := decodeCloudEvent(Message{ContentType: cloudEventsContentType, Body: []byte("{")}); err == nil {
+		t.Errorf("an invalid structured event should fail")
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// coordinatorLock is the id of the postgres advisory lock taken by the worker rebalancing the workflows
+const coordinatorLock = 0x776f726b666c6f77
+
+// heartbeatInterval is the period of the heartbeat of the workers
+var heartbeatInterval = 10 * time.Second
+
+// workerTimeout is the delay without heartbeat after which a worker is dead
+var workerTimeout = 30 * time.Second
+
+// hashAssignment assign the workflows to the alive workers by consistent hashing of their id,
+// instead of their worker column
+var hashAssignment bool
+
+// workerInfo is a member of the cluster of workers
+type workerInfo struct {
+	Name        string    `json:"name"`
+	StartedAt   time.Time `json:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+	Alive       bool      `json:"alive"`
+	// Workflows is the number of workflows assigned to the worker
+	Workflows int `json:"workflows"`
+}
+
+// heartbeat register the worker and refresh its heartbeat periodically
+func (h *handler) heartbeat() {
+	startedAt := time.Now()
+	for {
+		_, err := h.db.Exec(`INSERT INTO worker (name, started_at, heartbeat_at) VALUES ($1,$2,NOW())
+			ON CONFLICT (name) DO UPDATE SET started_at=$2, heartbeat_at=NOW();`, h.workerName, startedAt)
+		if err != nil {
+			log.Printf("cannot send the heartbeat of %v: %v", h.workerName, err)
+		}
+		if h.mqtt != nil && h.mqtt.config.SharedGroup == "" {
+			if workers, err := listWorkers(h.db); err == nil {
+				h.mqtt.warnUnshared(workers)
+			}
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// listWorkers return the registered workers with their load, the alive and least loaded first
+func listWorkers(db queryer) ([]workerInfo, error) {
+	query := `SELECT name, started_at, heartbeat_at, heartbeat_at > NOW() - $1::float8 * INTERVAL '1 second', COUNT(w.id)
+	FROM worker LEFT JOIN (
+		SELECT id, worker
+		FROM workflow JOIN (
+			SELECT id as maxid, MAX(revision) as maxr
+			FROM workflow
+			WHERE deleted_at IS NULL
+			GROUP BY maxid
+		) l
+		ON l.maxr = revision AND l.maxid = id
+	) w
+	ON w.worker = name
+	GROUP BY name
+	ORDER BY 4 DESC, 5, name
+	;`
+	rows, err := db.Query(query, workerTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var workers []workerInfo
+	for rows.Next() {
+		var w workerInfo
+		if err := rows.Scan(&w.Name, &w.StartedAt, &w.HeartbeatAt, &w.Alive, &w.Workflows); err != nil {
+			return nil, err
+		}
+		workers = append(workers, w)
+	}
+	return workers, rows.Err()
+}
+
+// placeWorkflow return the alive worker with the fewest workflows, this worker if none is known
+func (h *handler) placeWorkflow() string {
+	workers, err := listWorkers(h.db)
+	if err != nil {
+		log.Printf("cannot list the workers: %v", err)
+		return h.workerName
+	}
+	if len(workers) == 0 || !workers[0].Alive {
+		return h.workerName
+	}
+	return workers[0].Name
+}
+
+// coordinate periodically move the workflows of the dead workers to the alive ones.
+// Only one worker rebalance at a time. The workers started at the same time are given
+// workerTimeout to register before their workflows are moved.
+func (h *handler) coordinate() {
+	started := time.Now()
+	for {
+		time.Sleep(heartbeatInterval)
+		if time.Since(started) < workerTimeout {
+			continue
+		}
+		moved, err := h.rebalance()
+		if err != nil {
+			log.Printf("cannot rebalance the workflows: %v", err)
+			continue
+		}
+		for _, w := range moved {
+			log.Printf("move workflow %v %v to %v", w.AccountID, w.ID, w.Worker)
+			if err := h.sendStarCommand(w); err != nil {
+				log.Printf("cannot start workflow %v %v on %v: %v", w.AccountID, w.ID, w.Worker, err)
+			}
+		}
+	}
+}
+
+// rebalance assign the workflows of the dead or unregistered workers to the least loaded alive workers
+// and forget the dead workers.
+// It returns the moved workflows, nothing if another worker hold the coordinator lock.
+func (h *handler) rebalance() ([]dbWorkflow, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var leader bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1);", coordinatorLock).Scan(&leader); err != nil {
+		return nil, err
+	}
+	if !leader {
+		return nil, nil
+	}
+
+	workers, err := listWorkers(tx)
+	if err != nil {
+		return nil, err
+	}
+	alive := make([]workerInfo, 0, len(workers))
+	for _, w := range workers {
+		if w.Alive {
+			alive = append(alive, w)
+		}
+	}
+	if len(alive) == 0 {
+		return nil, nil
+	}
+
+	query := `SELECT ` + workflowColumns + `
+	FROM workflow JOIN (
+		SELECT id as maxid, MAX(revision) as maxr
+		FROM workflow
+		WHERE deleted_at IS NULL
+		GROUP BY maxid
+	) w
+	ON w.maxr = revision AND w.maxid = id
+	WHERE worker NOT IN (SELECT name FROM worker WHERE heartbeat_at > NOW() - $1::float8 * INTERVAL '1 second')
+	;`
+	rows, err := tx.Query(query, workerTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	var moved []dbWorkflow
+	for rows.Next() {
+		w, err := scanWorkflow(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		moved = append(moved, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range moved {
+		least := 0
+		for j := range alive {
+			if alive[j].Workflows < alive[least].Workflows {
+				least = j
+			}
+		}
+		moved[i].Worker = alive[least].Name
+		alive[least].Workflows++
+		if _, err := tx.Exec("UPDATE workflow SET worker=$1 WHERE id=$2;", moved[i].Worker, moved[i].ID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM worker WHERE heartbeat_at <= NOW() - $1::float8 * INTERVAL '1 second';", workerTimeout.Seconds()); err != nil {
+		return nil, err
+	}
+	return moved, tx.Commit()
+}
+
+// owns return true if the workflow assigned to worker must run on this worker
+func (h *handler) owns(worker, wid string) bool {
+	if !hashAssignment {
+		return worker == h.workerName
+	}
+	return h.ringOwner(wid) == h.workerName
+}
+
+// ringOwner return the worker owning the workflow with the hash assignment, empty until the members are known
+func (h *handler) ringOwner(wid string) string {
+	h.ringLock.RLock()
+	defer h.ringLock.RUnlock()
+	if h.ring == nil {
+		return ""
+	}
+	return h.ring.owner(wid)
+}
+
+// watchRing periodically update the ring with the alive workers,
+// the workflows are started and stopped by startWorkflows when the members change
+func (h *handler) watchRing() {
+	for {
+		workers, err := listWorkers(h.db)
+		if err != nil {
+			log.Printf("cannot list the workers: %v", err)
+			time.Sleep(heartbeatInterval)
+			continue
+		}
+		// this worker is alive even before its first heartbeat
+		members := []string{h.workerName}
+		for _, w := range workers {
+			if w.Alive {
+				members = append(members, w.Name)
+			}
+		}
+
+		h.ringLock.Lock()
+		changed := h.ring == nil || !h.ring.sameMembers(members)
+		if changed {
+			h.ring = newHashRing(members)
+			log.Printf("workers ring %v", h.ring.members)
+		}
+		h.ringLock.Unlock()
+
+		if changed {
+			h.startWorkflows()
+		}
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// localWorkflows return the id of the running and paused workflows of this worker
+func (h *handler) localWorkflows() []string {
+	h.sensorLock.RLock()
+	defer h.sensorLock.RUnlock()
+	wids := make([]string, 0, len(h.workflows)+len(h.paused))
+	for wid := range h.workflows {
+		wids = append(wids, wid)
+	}
+	for wid := range h.paused {
+		wids = append(wids, wid)
+	}
+	return wids
+}
+
+// isLocal return true if the workflow is running or paused on this worker
+func (h *handler) isLocal(wid string) bool {
+	h.sensorLock.RLock()
+	defer h.sensorLock.RUnlock()
+	_, running := h.workflows[wid]
+	_, paused := h.paused[wid]
+	return running || paused
+}
+
+// getWorkers list the registered workers with their heartbeat and number of workflows
+func (h *handler) getWorkers(c echo.Context) error {
+	workers, err := listWorkers(h.db)
+	if err != nil {
+		c.Logger().Errorf("cannot list the workers: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, workers)
+}
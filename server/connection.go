@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// maxReconnectDelay is the maximum delay between two connection attempts to RabbitMQ
+const maxReconnectDelay = 30 * time.Second
+
+var errNotConnected = errors.New("not connected to RabbitMQ")
+
+// amqpManager keep a connection to RabbitMQ open, it reconnects with an exponential backoff when the connection is lost.
+// The users open their channels on the current connection and declare again their exchanges, queues and consumers
+// when their deliveries channel is closed.
+type amqpManager struct {
+	uri string
+
+	mu    sync.Mutex
+	conn  *amqp.Connection
+	ready chan struct{} // closed when conn is set
+}
+
+// dialAMQP start to connect to RabbitMQ in background
+func dialAMQP(uri string) *amqpManager {
+	m := &amqpManager{
+		uri:   uri,
+		ready: make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *amqpManager) run() {
+	delay := time.Second
+	connected := false // true once connected, the next connections are reconnections
+	for {
+		conn, err := amqp.Dial(m.uri)
+		if err != nil {
+			log.Printf("cannot connect to RabbitMQ, retry in %v: %v", delay, err)
+			time.Sleep(delay)
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			continue
+		}
+		delay = time.Second
+		if connected {
+			amqpReconnects.Inc()
+		}
+		connected = true
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		m.mu.Lock()
+		m.conn = conn
+		close(m.ready)
+		m.mu.Unlock()
+		log.Println("connected to RabbitMQ")
+
+		err = <-closed
+		log.Printf("connection to RabbitMQ lost: %v", err)
+
+		m.mu.Lock()
+		m.conn = nil
+		m.ready = make(chan struct{})
+		m.mu.Unlock()
+	}
+}
+
+// current return the open connection, nil while reconnecting
+func (m *amqpManager) current() *amqp.Connection {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conn
+}
+
+// wait until the connection is open and return it. It returns nil if stop is closed before.
+func (m *amqpManager) wait(stop <-chan struct{}) *amqp.Connection {
+	for {
+		m.mu.Lock()
+		conn, ready := m.conn, m.ready
+		m.mu.Unlock()
+		if conn != nil && !conn.IsClosed() {
+			return conn
+		}
+		select {
+		case <-ready:
+		case <-stop:
+			return nil
+		case <-time.After(time.Second):
+			// the connection may be closed but not yet reported
+		}
+	}
+}
+
+// amqpPublisher publish on a channel of the current connection, the channel is opened again after a reconnection
+type amqpPublisher struct {
+	mq      *amqpManager
+	declare func(*amqp.Channel) error
+
+	mu sync.Mutex
+	ch *amqp.Channel
+}
+
+func newAMQPPublisher(mq *amqpManager, declare func(*amqp.Channel) error) *amqpPublisher {
+	return &amqpPublisher{mq: mq, declare: declare}
+}
+
+// Publish the message, it is tried again once on a new channel if the current one is closed
+func (p *amqpPublisher) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	for try := 0; try < 2; try++ {
+		if p.ch == nil {
+			if p.ch, err = p.open(); err != nil {
+				return err
+			}
+		}
+		err = p.ch.Publish(exchange, key, mandatory, immediate, msg)
+		if err == nil {
+			return nil
+		}
+		p.ch.Close()
+		p.ch = nil
+	}
+	return err
+}
+
+func (p *amqpPublisher) open() (*amqp.Channel, error) {
+	conn := p.mq.current()
+	if conn == nil {
+		return nil, errNotConnected
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if p.declare != nil {
+		if err := p.declare(ch); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	return ch, nil
+}
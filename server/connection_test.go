@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestAMQPManagerDisconnected(t *testing.T) {
+	// a manager which never connect
+	m := &amqpManager{ready: make(chan struct{})}
+
+	stop := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(stop)
+	}()
+	if conn := m.wait(stop); conn != nil {
+		t.Errorf("wait should return nil when stopped")
+	}
+
+	p := newAMQPPublisher(m, nil)
+	if err := p.Publish("workflow", "w.a.b.start", false, false, amqp.Publishing{}); err != errNotConnected {
+		t.Errorf("expected %v got %v", errNotConnected, err)
+	}
+}
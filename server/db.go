@@ -3,17 +3,21 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"time"
 
+	workflow "github.com/fredericalix/yic_workflow-engine"
 	"github.com/gofrs/uuid"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 func newPostgreSQL(uri string) (*sql.DB, error) {
-	db, err := sql.Open("postgres", uri)
+	connector, err := pq.NewConnector(uri)
 	if err != nil {
 		return nil, err
 	}
+	// the duration of the queries is measured by the connections
+	db := sql.OpenDB(timedConnector{connector})
 	// test the connection
 	err = db.Ping()
 	if err != nil {
@@ -30,7 +34,56 @@ func newPostgreSQL(uri string) (*sql.DB, error) {
 		graph JSONB NOT NULL
 	);
 	CREATE INDEX IF NOT EXISTS workflow_id_aid_rec ON workflow (account_id,id,created_at);
-	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS worker TEXT NOT NULL DEFAULT 'workflow-engine0';`
+	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS worker TEXT NOT NULL DEFAULT 'workflow-engine0';
+	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS tests JSONB NOT NULL DEFAULT '[]';
+	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0;
+	UPDATE workflow SET revision = v.n FROM (
+		SELECT id AS vid, created_at AS vc, ROW_NUMBER() OVER (PARTITION BY id ORDER BY created_at) AS n FROM workflow
+	) v
+	WHERE revision = 0 AND id = v.vid AND created_at = v.vc;
+	CREATE UNIQUE INDEX IF NOT EXISTS workflow_id_revision ON workflow (id,revision);
+	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT TRUE;
+	ALTER TABLE workflow ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	CREATE TABLE IF NOT EXISTS worker (
+		name TEXT PRIMARY KEY,
+		started_at TIMESTAMPTZ NOT NULL,
+		heartbeat_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS workflow_state (
+		id UUID PRIMARY KEY,
+		account_id UUID NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		state JSONB NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS workflow_output (
+		account_id UUID NOT NULL,
+		workflow_id UUID NOT NULL,
+		version TEXT NOT NULL,
+		output_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		value JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS workflow_output_wid_rec ON workflow_output (workflow_id,created_at);
+	CREATE INDEX IF NOT EXISTS workflow_output_created_at ON workflow_output (created_at);
+	ALTER TABLE workflow_output ADD COLUMN IF NOT EXISTS revision INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE IF NOT EXISTS workflow_webhook_delivery (
+		id UUID PRIMARY KEY,
+		account_id UUID NOT NULL,
+		workflow_id UUID NOT NULL,
+		output_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		status TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		attempts INTEGER NOT NULL,
+		latency_ms DOUBLE PRECISION NOT NULL,
+		error TEXT NOT NULL,
+		response TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		finished_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS workflow_webhook_delivery_wid_rec ON workflow_webhook_delivery (workflow_id,created_at);
+	CREATE INDEX IF NOT EXISTS workflow_webhook_delivery_created_at ON workflow_webhook_delivery (created_at);`
 	_, err = db.Query(query)
 	if err != nil {
 		return nil, err
@@ -40,10 +93,101 @@ func newPostgreSQL(uri string) (*sql.DB, error) {
 
 type dbWorkflow struct {
 	ID        uuid.UUID       `json:"id,omitempty"`
+	Revision  int             `json:"revision,omitempty"` // version number, incremented on each new version
 	CreatedAt time.Time       `json:"created_at,omitempty"`
 	AccountID uuid.UUID       `json:"accound_id,omitempty"`
 	Worker    string          `json:"worker,omitempty"`
 	Name      string          `json:"name,omitempty"`
 	Version   string          `json:"version,omitempty"`
 	Graph     json.RawMessage `json:"graph,omitempty"`
+	Tests     json.RawMessage `json:"tests,omitempty"`
+	Enabled   bool            `json:"enabled"`              // false when paused, the same for every version
+	DeletedAt *time.Time      `json:"deleted_at,omitempty"` // set when the workflow is in the trash
+}
+
+// workflowColumns are the columns scanned by scanWorkflow
+const workflowColumns = "account_id, id, revision, created_at, name, worker, version, graph, tests, enabled, deleted_at"
+
+// scanWorkflow scan a row of workflowColumns
+func scanWorkflow(row interface{ Scan(...interface{}) error }) (dbWorkflow, error) {
+	var w dbWorkflow
+	err := row.Scan(&w.AccountID, &w.ID, &w.Revision, &w.CreatedAt, &w.Name, &w.Worker, &w.Version, &w.Graph, &w.Tests, &w.Enabled, &w.DeletedAt)
+	return w, err
+}
+
+// errConflict is returned when a version of the workflow has been inserted concurrently
+var errConflict = errors.New("conflicting version of the workflow")
+
+// insertWorkflow insert a new version of the workflow with the next revision number.
+// If base is not negative, errConflict is returned when the latest version is not base (0 for a new workflow).
+// The new version keep the enabled state of the workflow, a workflow in the trash cannot get new versions.
+// The id of a workflow of another account is rejected with errConflict.
+func insertWorkflow(db *sql.DB, w *dbWorkflow, base int) error {
+	query := `INSERT INTO workflow (account_id, id, revision, created_at, worker, name, version, graph, tests, enabled)
+		SELECT $1, $2, COALESCE(MAX(revision), 0) + 1, $3, $4, $5, $6, $7, $8, COALESCE(bool_and(enabled), TRUE) FROM workflow WHERE id = $2 AND account_id = $1
+		HAVING ($9 < 0 OR COALESCE(MAX(revision), 0) = $9) AND COUNT(deleted_at) = 0
+			AND NOT EXISTS (SELECT 1 FROM workflow WHERE id = $2 AND account_id <> $1)
+		RETURNING revision, enabled;`
+	err := db.QueryRow(query, w.AccountID, w.ID, w.CreatedAt, w.Worker, w.Name, w.Version, w.Graph, w.Tests, base).Scan(&w.Revision, &w.Enabled)
+	if err == sql.ErrNoRows {
+		return errConflict
+	}
+	if err, ok := err.(*pq.Error); ok && err.Code == "23505" {
+		return errConflict
+	}
+	return err
+}
+
+// loadState return the last saved runtime state of the workflow, nil if there is none
+func loadState(db *sql.DB, wid uuid.UUID) (*workflow.Snapshot, error) {
+	var raw []byte
+	err := db.QueryRow("SELECT state FROM workflow_state WHERE id=$1;", wid).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s workflow.Snapshot
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// execLocked execute the query if the postgres advisory lock is free, so only one worker execute it at a time.
+// The result is nil if another worker hold the lock.
+func execLocked(db *sql.DB, lock int64, query string, args ...interface{}) (sql.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow("SELECT pg_try_advisory_xact_lock($1);", lock).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, nil
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return res, tx.Commit()
+}
+
+// saveState of the workflow.
+// The state of a purged workflow is not saved: the workflow is stopped asynchronously and
+// its last state may be saved after the workflow and its state are deleted.
+func saveState(db *sql.DB, aid, wid uuid.UUID, s workflow.Snapshot) error {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO workflow_state (id, account_id, updated_at, state)
+		SELECT $1::uuid, $2::uuid, NOW(), $3::jsonb WHERE EXISTS (SELECT 1 FROM workflow WHERE id=$1::uuid)
+		ON CONFLICT (id) DO UPDATE SET updated_at=NOW(), state=$3::jsonb;`, wid, aid, raw)
+	return err
 }
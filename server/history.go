@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// historyRow is an output value to store in the history
+type historyRow struct {
+	AID       uuid.UUID
+	WID       uuid.UUID
+	Version   string
+	Revision  int
+	OutputID  string
+	Name      string
+	Value     []byte
+	CreatedAt time.Time
+}
+
+// historyWriter store the published output values in batch, out of the workflow goroutines
+type historyWriter struct {
+	db   *sql.DB
+	rows chan historyRow
+}
+
+func newHistoryWriter(db *sql.DB) *historyWriter {
+	return &historyWriter{
+		db:   db,
+		rows: make(chan historyRow, 4096),
+	}
+}
+
+// add every field of a published output message to the history
+func (hw *historyWriter) add(w dbWorkflow, sid string, out map[string]interface{}) {
+	createdAt := time.Now()
+	if s, ok := out["created_at"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			createdAt = t
+		}
+	}
+	for name, value := range out {
+		if name == "id" || name == "created_at" || name == "explain" {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			log.Printf("cannot store output %v.%v.%v: %v", w.ID, sid, name, err)
+			continue
+		}
+		select {
+		case hw.rows <- historyRow{AID: w.AccountID, WID: w.ID, Version: w.Version, Revision: w.Revision, OutputID: sid, Name: name, Value: raw, CreatedAt: createdAt}:
+		default:
+			log.Printf("output history full, drop %v.%v.%v", w.ID, sid, name)
+		}
+	}
+}
+
+// run insert the values by batch of at most 500 rows or every second
+func (hw *historyWriter) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]historyRow, 0, 500)
+	for {
+		select {
+		case r := <-hw.rows:
+			batch = append(batch, r)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := hw.insert(batch); err != nil {
+			log.Printf("cannot insert %d output values in the history: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (hw *historyWriter) insert(batch []historyRow) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO workflow_output (account_id, workflow_id, version, revision, output_id, name, value, created_at) VALUES ")
+	args := make([]interface{}, 0, len(batch)*8)
+	for i, r := range batch {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		n := len(args)
+		query.WriteString("($" + strconv.Itoa(n+1))
+		for j := 2; j <= 8; j++ {
+			query.WriteString(",$" + strconv.Itoa(n+j))
+		}
+		query.WriteString(")")
+		args = append(args, r.AID, r.WID, r.Version, r.Revision, r.OutputID, r.Name, r.Value, r.CreatedAt)
+	}
+	_, err := hw.db.Exec(query.String(), args...)
+	return err
+}
+
+// historyPurgeLock is the id of the postgres advisory lock taken by the worker purging the output history
+const historyPurgeLock = 0x686973746f7279
+
+// purge hourly the values older than the retention, a retention of 0 keep every value.
+// The workers purge one at a time.
+func (hw *historyWriter) purge(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	for {
+		res, err := execLocked(hw.db, historyPurgeLock, "DELETE FROM workflow_output WHERE created_at < $1;", time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("cannot purge the output history: %v", err)
+		} else if res != nil {
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("purge %d output values older than %v", n, retention)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// outputValue is a value of the output history
+type outputValue struct {
+	OutputID  string          `json:"output_id"`
+	Name      string          `json:"name"`
+	Version   string          `json:"version,omitempty"`
+	Revision  int             `json:"revision,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// swagger:response outputHistoryResponse
+type outputHistoryResponse struct {
+	// in: body
+	Body []outputValue
+}
+
+// swagger:route GET /workflow/outputs/{id}/history Workflow outputHistory
+//
+// Output History
+//
+// Get the values published by the outputs of the workflow, ordered by time.
+// Query parameters: from and to (RFC3339, default the last 24 hours), name of the output field,
+// limit (default 1000, max 10000) and offset for the pagination,
+// step (duration like 5m) to downsample the values, the numbers are averaged, the other values keep the last one.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: outputHistoryResponse
+//       400:
+//       500:
+func (h *handler) getOutputHistory(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid, err := uuid.FromString(c.Param("wid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+
+	badRequest := func(msg string) error {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": msg})
+	}
+	to := time.Now()
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return badRequest("invalid to: " + err.Error())
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return badRequest("invalid from: " + err.Error())
+		}
+	}
+	limit := 1000
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 10000 {
+			return badRequest("invalid limit")
+		}
+	}
+	offset := 0
+	if s := c.QueryParam("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return badRequest("invalid offset")
+		}
+	}
+	var step time.Duration
+	if s := c.QueryParam("step"); s != "" {
+		if step, err = time.ParseDuration(s); err != nil || step < time.Second {
+			return badRequest("invalid step")
+		}
+	}
+	name := c.QueryParam("name")
+
+	var rows *sql.Rows
+	if step == 0 {
+		query := `SELECT output_id, name, version, revision, value, created_at
+		FROM workflow_output
+		WHERE account_id = $1 AND workflow_id = $2 AND created_at >= $3 AND created_at <= $4 AND ($5 = '' OR name = $5)
+		ORDER BY created_at, name
+		LIMIT $6 OFFSET $7;`
+		rows, err = h.db.Query(query, account.ID, wid, from, to, name, limit, offset)
+	} else {
+		query := `SELECT output_id, name, '', 0,
+			CASE WHEN bool_and(jsonb_typeof(value) = 'number')
+				THEN to_jsonb(avg((value#>>'{}')::float8) FILTER (WHERE jsonb_typeof(value) = 'number'))
+				ELSE (array_agg(value ORDER BY created_at DESC))[1]
+			END,
+			to_timestamp(floor(extract(epoch FROM created_at) / $8) * $8) AS bucket
+		FROM workflow_output
+		WHERE account_id = $1 AND workflow_id = $2 AND created_at >= $3 AND created_at <= $4 AND ($5 = '' OR name = $5)
+		GROUP BY output_id, name, bucket
+		ORDER BY bucket, name
+		LIMIT $6 OFFSET $7;`
+		rows, err = h.db.Query(query, account.ID, wid, from, to, name, limit, offset, step.Seconds())
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find output history for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	values := make([]outputValue, 0, 64)
+	for rows.Next() {
+		var v outputValue
+		if err := rows.Scan(&v.OutputID, &v.Name, &v.Version, &v.Revision, &v.Value, &v.CreatedAt); err != nil {
+			c.Logger().Errorf("cannot scan output history for %v.%v: %v", account.ID, wid, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		values = append(values, v)
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("cannot find output history for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, values)
+}
@@ -8,13 +8,16 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
-	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 
 	auth "github.com/fredericalix/yic_auth"
 	workflow "github.com/fredericalix/yic_workflow-engine"
@@ -34,17 +37,91 @@ type handler struct {
 
 	db *sql.DB
 
-	conn      *amqp.Connection
-	sendCmdCh *amqp.Channel
+	transport Transport
+	outputs   *outputPublisher
+	router    *sensorRouter
+	mqtt      *mqttBridge // nil without MQTT_URI
 
 	workflows  map[string]*Workflow
+	paused     map[string]dbWorkflow // the disabled workflows of this worker, guarded by sensorLock
 	sensorLock sync.RWMutex
+	// lifecycle serialize the start and stop of the workflows,
+	// sensorLock is only locked to swap them so the slow steps do not block the readers
+	lifecycle sync.Mutex
+
+	ring     *hashRing // the alive workers with the hash assignment, nil until known
+	ringLock sync.RWMutex
+
+	stream     *outputHub
+	history    *historyWriter
+	webhooks   *webhookDispatcher
+	webhookLog *webhookLog
+}
+
+// handlerConfig is the configuration of the worker
+type handlerConfig struct {
+	WorkerName    string
+	StreamHistory int // the output messages kept for the streams resumed
+
+	OutputBuffer      int
+	OutputMandatory   bool
+	OutputCloudEvents string // binary or structured to publish the outputs as CloudEvents
+
+	WebhookWorkers     int
+	WebhookQueue       int
+	WebhookTimeout     time.Duration
+	WebhookMaxAttempts int
+}
+
+// newHandler of the worker storing the workflows in db and receiving the messages with the transport.
+// The outputs are published and the sensor messages dispatched in background,
+// the history and the webhook log are only written once their run is started.
+func newHandler(config handlerConfig, db *sql.DB, t Transport) *handler {
+	h := &handler{
+		workerName: config.WorkerName,
+		db:         db,
+		transport:  t,
+		workflows:  make(map[string]*Workflow),
+		paused:     make(map[string]dbWorkflow),
+		stream:     newOutputHub(config.StreamHistory),
+		history:    newHistoryWriter(db),
+		webhookLog: newWebhookLog(db),
+	}
+	h.webhooks = newWebhookDispatcher(config.WebhookWorkers, config.WebhookQueue,
+		config.WebhookTimeout, config.WebhookMaxAttempts, h.webhookLog.add)
+	h.outputs = newOutputPublisher(t, config.OutputBuffer, config.OutputMandatory, config.OutputCloudEvents)
+	go h.outputs.run()
+	h.router = newSensorRouter(t, h.workerName)
+	h.router.observe = h.observeOutput
+	return h
 }
 
 func main() {
 	viper.AutomaticEnv()
 	viper.SetDefault("PORT", "8080")
 	viper.SetDefault("WORKER_NAME", "workflow-engine0")
+	viper.SetDefault("RECORD_SIZE", 1000)
+	viper.SetDefault("STATE_SNAPSHOT_INTERVAL", "30s")
+	viper.SetDefault("STREAM_HISTORY", 1000)
+	viper.SetDefault("OUTPUT_HISTORY_RETENTION", "720h")
+	viper.SetDefault("TRASH_RETENTION", "720h")
+	viper.SetDefault("WEBHOOK_WORKERS", 16)
+	viper.SetDefault("WEBHOOK_QUEUE", 10000)
+	viper.SetDefault("WEBHOOK_TIMEOUT", "10s")
+	viper.SetDefault("WEBHOOK_MAX_ATTEMPTS", 5)
+	viper.SetDefault("WEBHOOK_LOG_RETENTION", "720h")
+	viper.SetDefault("HEARTBEAT_INTERVAL", "10s")
+	viper.SetDefault("WORKER_TIMEOUT", "30s")
+	viper.SetDefault("ASSIGNMENT", "static")
+	viper.SetDefault("OUTPUT_BUFFER", 10000)
+	viper.SetDefault("SENSOR_PREFETCH", 256)
+	viper.SetDefault("TRANSPORT", "amqp")
+	viper.SetDefault("MQTT_SENSOR_TOPIC", "sensors")
+	viper.SetDefault("MQTT_OUTPUT_TOPIC", "outputs")
+	viper.SetDefault("MQTT_SHARED_GROUP", "")
+	viper.SetDefault("MQTT_QOS", 1)
+	viper.SetDefault("OTLP_ENDPOINT", "http://localhost:4318/v1/traces")
+	viper.SetDefault("TRACE_SAMPLE_RATIO", 1.0)
 
 	configFile := flag.String("config", "./config.toml", "path of the config file")
 	flag.Parse()
@@ -54,15 +131,68 @@ func main() {
 		log.Printf("cannot read config file: %v\nUse env instead\n", err)
 	}
 
-	h := &handler{
-		workerName: viper.GetString("WORKER_NAME"),
-		workflows:  make(map[string]*Workflow),
+	explainOutputs = viper.GetBool("EXPLAIN_OUTPUTS")
+	snapshotInterval = viper.GetDuration("STATE_SNAPSHOT_INTERVAL")
+	heartbeatInterval = viper.GetDuration("HEARTBEAT_INTERVAL")
+	workerTimeout = viper.GetDuration("WORKER_TIMEOUT")
+	switch a := viper.GetString("ASSIGNMENT"); a {
+	case "static":
+	case "hash":
+		hashAssignment = true
+	default:
+		log.Fatalf("unknown ASSIGNMENT %s, expect static or hash", a)
+	}
+
+	if e := viper.GetString("TRACING"); e != "" {
+		provider, err := newTracerProvider(e, viper.GetString("OTLP_ENDPOINT"), viper.GetString("WORKER_NAME"), viper.GetFloat64("TRACE_SAMPLE_RATIO"))
+		failOnError(err, "Failed to configure the tracing")
+		tracing = provider.Tracer(instrumentationName)
+	}
+
+	config := handlerConfig{
+		WorkerName:         viper.GetString("WORKER_NAME"),
+		StreamHistory:      viper.GetInt("STREAM_HISTORY"),
+		OutputBuffer:       viper.GetInt("OUTPUT_BUFFER"),
+		OutputMandatory:    viper.GetBool("OUTPUT_MANDATORY"),
+		OutputCloudEvents:  viper.GetString("OUTPUT_CLOUDEVENTS"),
+		WebhookWorkers:     viper.GetInt("WEBHOOK_WORKERS"),
+		WebhookQueue:       viper.GetInt("WEBHOOK_QUEUE"),
+		WebhookTimeout:     viper.GetDuration("WEBHOOK_TIMEOUT"),
+		WebhookMaxAttempts: viper.GetInt("WEBHOOK_MAX_ATTEMPTS"),
+	}
+	if ce := config.OutputCloudEvents; ce != "" && ce != "binary" && ce != "structured" {
+		log.Fatalf("unknown OUTPUT_CLOUDEVENTS %s, expect binary or structured", ce)
 	}
 
-	h.db, err = newPostgreSQL(viper.GetString("POSTGRESQL_URI"))
+	db, err := newPostgreSQL(viper.GetString("POSTGRESQL_URI"))
 	failOnError(err, "Failed to connect to PostgreSQL")
-	h.conn, err = amqp.Dial(viper.GetString("RABBITMQ_URI"))
-	failOnError(err, "Failed to connect to RabbitMQ")
+	var transport Transport
+	switch t := viper.GetString("TRANSPORT"); t {
+	case "amqp":
+		transport = newAMQPTransport(viper.GetString("RABBITMQ_URI"), config.WorkerName, viper.GetInt("SENSOR_PREFETCH"))
+	case "memory":
+		transport = newMemoryTransport()
+	default:
+		log.Fatalf("unknown TRANSPORT %s, expect amqp or memory", t)
+	}
+
+	h := newHandler(config, db, transport)
+	go h.history.run()
+	go h.history.purge(viper.GetDuration("OUTPUT_HISTORY_RETENTION"))
+	go h.purgeTrash(viper.GetDuration("TRASH_RETENTION"))
+	go h.webhookLog.run()
+	go h.webhookLog.purge(viper.GetDuration("WEBHOOK_LOG_RETENTION"))
+	if uri := viper.GetString("MQTT_URI"); uri != "" {
+		h.mqtt, err = newMQTTBridge(mqttConfig{
+			URI:         uri,
+			ClientID:    h.workerName,
+			SensorTopic: viper.GetString("MQTT_SENSOR_TOPIC"),
+			OutputTopic: viper.GetString("MQTT_OUTPUT_TOPIC"),
+			SharedGroup: viper.GetString("MQTT_SHARED_GROUP"),
+			QoS:         byte(viper.GetInt("MQTT_QOS")),
+		}, h.transport)
+		failOnError(err, "Failed to configure the MQTT bridge")
+	}
 
 	e := echo.New()
 	e.Use(middleware.Logger())
@@ -70,32 +200,62 @@ func main() {
 		return c.String(http.StatusOK, "Echo ping status OK\n")
 	})
 	e.GET("/workflow/running", h.getRunningWorkflow)
+	e.GET("/workflow/workers", h.getWorkers)
 	e.GET("/workflow/running/debug", h.getRunningWorkflowDebug)
 	e.GET("/workflow/running/debug/:id", h.getRunningWorkflowDebugDot)
 	e.GET("/workflow/operation", getPossibleOperator)
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(newMetricsRegistry(h), promhttp.HandlerOpts{})))
 	e.GET("/workflow/debug/pprof/*", echo.WrapHandler(http.DefaultServeMux), middleware.Rewrite(map[string]string{"/workflow/*": "/$1"}))
 
 	roles := auth.Roles{"ui": "rw"}
 	sessions := auth.NewValidHTTP(viper.GetString("AUTH_CHECK_URI"))
 	authM := auth.Middleware(sessions, roles)
 	e.GET("/workflow", h.getWorkflows, authM)
+	e.GET("/workflow/trash", h.getTrash, authM)
 	e.GET("/workflow/:wid", h.getWorkflowID, authM)
 	e.GET("/workflow/history/:wid", h.getWorkflowIDHistory, authM)
+	e.GET("/workflow/:wid/versions", h.getWorkflowIDHistory, authM)
+	e.GET("/workflow/:wid/versions/:n", h.getWorkflowVersion, authM)
+	e.GET("/workflow/:wid/versions/:n/diff/:m", h.getWorkflowDiff, authM)
+	e.POST("/workflow/:wid/rollback/:n", h.postWorkflowRollback, authM)
 	e.POST("/workflow", h.postWorkflow, authM)
+	e.POST("/workflow/simulate", h.postWorkflowSimulate, authM)
+	e.POST("/workflow/:wid/test", h.postWorkflowTest, authM)
+	e.PUT("/workflow/:wid", h.putWorkflow, authM)
+	e.POST("/workflow/:wid/pause", h.postWorkflowPause, authM)
+	e.POST("/workflow/:wid/resume", h.postWorkflowResume, authM)
+	e.PATCH("/workflow/:wid", h.patchWorkflow, authM)
 	e.DELETE("/workflow/:wid", h.deleteWorkflow, authM)
+	e.POST("/workflow/:wid/restore", h.postWorkflowRestore, authM)
 	e.GET("/workflow/outputs", h.getWorkflowOutput, authM)
 	e.GET("/workflow/outputs/:wid", h.getWorkflowOutputID, authM)
-
+	e.GET("/workflow/outputs/:wid/stream", h.getOutputStream, tokenFromQuery, authM)
+	e.GET("/workflow/outputs/:wid/history", h.getOutputHistory, authM)
+	e.GET("/workflow/:wid/webhooks/deliveries", h.getWebhookDeliveries, authM)
+	e.GET("/workflow/outputs/:wid/ws", h.getOutputWebSocket, tokenFromQuery, authM)
+	e.POST("/workflow/running/:id/record", h.startRecording, authM)
+	e.GET("/workflow/running/:id/record", h.getRecording, authM)
+	e.DELETE("/workflow/running/:id/record", h.stopRecording, authM)
+	e.POST("/workflow/running/:id/replay", h.postReplay, authM)
+	e.GET("/workflow/running/:id/explain/:output", h.getExplain, authM)
+
+	// the workflows are started once connected, they reconnect by themselves.
+	// The server is started meanwhile to answer the health checks and the metrics.
 	go func() {
-		log.Fatalf("closing: %s", <-h.conn.NotifyClose(make(chan *amqp.Error)))
+		h.transport.Wait()
+		go h.transport.ConsumeCommands(h.handleIncomingCommand)
+		go h.transport.ConsumeAccountDeletions(h.handleAccountDeleted)
+
+		go h.heartbeat()
+		if hashAssignment {
+			// the workflows are started when the members are known
+			go h.watchRing()
+		} else {
+			go h.coordinate()
+			go h.startWorkflows()
+		}
 	}()
 
-	h.sendCmdCh = openCommandChannel(h.conn, h.workerName)
-	go h.handleIncomingCommand()
-	go h.handleAccountDeleted()
-
-	go h.startWorkflows()
-
 	// start the server
 	host := ":" + viper.GetString("PORT")
 	tlscert := viper.GetString("TLS_CERT")
@@ -107,93 +267,281 @@ func main() {
 	e.Logger.Fatal(e.StartTLS(host, tlscert, tlskey))
 }
 
+// startWorkflows start the workflows owned by this worker which are not running yet.
+// With the hash assignment, the running workflows owned by another worker are stopped.
 func (h *handler) startWorkflows() {
-	query := `SELECT account_id, id, created_at, name, version, graph
+	if hashAssignment {
+		for _, wid := range h.localWorkflows() {
+			if !h.owns("", wid) && h.stopWorkflow(wid) {
+				log.Printf("STOP workflow %s owned by %s", wid, h.ringOwner(wid))
+			}
+		}
+	}
+
+	query := `SELECT ` + workflowColumns + `
 	FROM workflow JOIN (
-		SELECT id as maxid, MAX(created_at) as maxc
+		SELECT id as maxid, MAX(revision) as maxr
 		FROM workflow
 		GROUP BY account_id, maxid
 	) w
-	ON w.maxc = created_at AND w.maxid = id
-	WHERE worker=$1;`
-	rows, err := h.db.Query(query, h.workerName)
-	if err != nil && err != sql.ErrNoRows {
-		failOnError(err, "could not retreive workflow to lunch")
+	ON w.maxr = revision AND w.maxid = id
+	WHERE ($2 OR worker=$1) AND deleted_at IS NULL;`
+	rows, err := h.db.Query(query, h.workerName, hashAssignment)
+	if err != nil {
+		log.Printf("could not retreive workflow to lunch: %v", err)
+		return
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var w dbWorkflow
-		lerr := rows.Scan(&w.AccountID, &w.ID, &w.CreatedAt, &w.Name, &w.Version, &w.Graph)
+		w, lerr := scanWorkflow(rows)
 		if lerr != nil {
 			err = lerr
 			log.Printf("could not scan workflow from db: %v", err)
 			continue
 		}
+		if !h.owns(w.Worker, w.ID.String()) || h.isLocal(w.ID.String()) {
+			continue
+		}
 		if err := h.startWorkflow(w); err != nil {
 			log.Printf("could not lunch %v %v: %v", w.ID, w.AccountID, err)
 		}
 	}
 }
 
-func (h *handler) startWorkflow(w dbWorkflow) error {
-	graph := workflow.FlowGraph{
+// newFlowGraph parse the graph of the workflow, the graph is not built
+func newFlowGraph(w dbWorkflow) (*workflow.FlowGraph, error) {
+	graph := &workflow.FlowGraph{
 		ID:   w.ID,
 		AID:  w.AccountID,
 		Name: w.Name,
 	}
 	err := json.Unmarshal(w.Graph, &graph.Flow)
+	if err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// runWorkflowTests run the test cases stored with the workflow
+func runWorkflowTests(w dbWorkflow, graph *workflow.FlowGraph) ([]workflow.TestResult, error) {
+	var tests []workflow.TestCase
+	if len(w.Tests) > 0 {
+		if err := json.Unmarshal(w.Tests, &tests); err != nil {
+			return nil, fmt.Errorf("invalid tests: %v", err)
+		}
+	}
+	return workflow.RunTests(graph, tests), nil
+}
+
+// startWorkflow start the workflow or upgrade it in place if it is already running.
+// On upgrade the state of the nodes with the same key and type is carried over from the running version,
+// otherwise it is restored from the last saved state.
+// A disabled workflow is only registered as paused.
+func (h *handler) startWorkflow(w dbWorkflow) error {
+	if !w.Enabled {
+		h.pauseWorkflow(w)
+		return nil
+	}
+
+	graph, err := newFlowGraph(w)
 	if err != nil {
 		return err
 	}
 
-	wo, err := newWorkflow(h.conn, &graph, h.workerName)
+	aid, wid := w.AccountID.String(), w.ID.String()
+	hooks := workflowHooks{
+		saveState: func(s workflow.Snapshot) {
+			if err := saveState(h.db, w.AccountID, w.ID, s); err != nil {
+				log.Printf("could not save the state of %v %v: %v", w.AccountID, w.ID, err)
+			}
+		},
+		published: func(sid string, out map[string]interface{}, body []byte) {
+			createdAt, _ := out["created_at"].(string)
+			at, _ := time.Parse(time.RFC3339Nano, createdAt)
+			h.stream.publish(aid, wid, aid+"."+sid, body, at)
+			h.history.add(w, sid, out)
+			if h.mqtt != nil {
+				h.mqtt.publish(aid, sid, body)
+			}
+		},
+		webhook: func(sid, url string, body []byte, s trace.Span) {
+			h.webhooks.send(w.AccountID, w.ID, sid, url, body, s)
+		},
+	}
+
+	// the new version is bound to the sensors before the old one is stopped to not miss messages
+	wo, err := newWorkflow(h.transport, h.router, h.outputs, graph, hooks)
 	if err != nil {
 		return err
 	}
-	log.Printf("start workflow %v %v", w.AccountID, w.ID)
+
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+
+	h.sensorLock.RLock()
+	old, running := h.workflows[wid]
+	h.sensorLock.RUnlock()
+
+	var state *workflow.Snapshot
+	if running {
+		old.Stop()
+		s := old.graph.Snapshot()
+		state = &s
+		wo.setRecorder(old.recorder())
+		log.Printf("upgrade workflow %v %v", w.AccountID, w.ID)
+	} else {
+		state, err = loadState(h.db, w.ID)
+		if err != nil {
+			log.Printf("could not load the state of %v %v: %v", w.AccountID, w.ID, err)
+		}
+		log.Printf("start workflow %v %v", w.AccountID, w.ID)
+	}
+
+	if err = wo.run(state); err != nil {
+		// release the messages dispatched since the workflow was added to the router
+		wo.Stop()
+		if running {
+			h.sensorLock.Lock()
+			delete(h.workflows, wid)
+			h.sensorLock.Unlock()
+			h.outputs.forget(wid)
+			forgetWorkflowMetrics(aid, wid)
+		}
+		return err
+	}
 
 	h.sensorLock.Lock()
 	defer h.sensorLock.Unlock()
-	h.workflows[w.ID.String()] = wo
+	h.workflows[wid] = wo
+	delete(h.paused, wid)
 	return nil
 }
 
+// pauseWorkflow stop the workflow if it is running, its state is saved, and keep it as paused until resumed
+func (h *handler) pauseWorkflow(w dbWorkflow) {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+
+	wid := w.ID.String()
+	h.sensorLock.Lock()
+	wo, running := h.workflows[wid]
+	delete(h.workflows, wid)
+	h.paused[wid] = w
+	h.sensorLock.Unlock()
+
+	if running {
+		wo.Stop()
+		h.outputs.forget(wid)
+		forgetWorkflowMetrics(wo.graph.AID.String(), wid)
+	}
+}
+
 // stopWorkflow stop the given workflow, return true if the workflow was running, false otherwi
 func (h *handler) stopWorkflow(wid string) bool {
+	h.lifecycle.Lock()
+	defer h.lifecycle.Unlock()
+
 	h.sensorLock.Lock()
-	defer h.sensorLock.Unlock()
+	_, paused := h.paused[wid]
+	delete(h.paused, wid)
+	w, running := h.workflows[wid]
+	delete(h.workflows, wid)
+	h.sensorLock.Unlock()
 
-	w, found := h.workflows[wid]
-	if !found {
-		return false
+	if running {
+		w.Stop()
+		h.outputs.forget(wid)
+		forgetWorkflowMetrics(w.graph.AID.String(), wid)
 	}
-	delete(h.workflows, wid)
-	w.Stop()
-	return true
+	return running || paused
 }
 
+// getRunningWorkflow list the running and paused workflows of the worker.
+// With the hash assignment, every worker list all the workflows with the worker owning them.
 func (h *handler) getRunningWorkflow(c echo.Context) error {
 	type res struct {
-		ID   uuid.UUID `json:"id"`
-		AID  uuid.UUID `json:"account_id"`
-		Name string    `json:"name"`
+		ID     uuid.UUID `json:"id"`
+		AID    uuid.UUID `json:"account_id"`
+		Name   string    `json:"name"`
+		Worker string    `json:"worker"`
+		Paused bool      `json:"paused"`
+		// Outputs count the published output messages
+		Outputs *publishStats `json:"outputs,omitempty"`
 	}
 	var ws []res
+	if hashAssignment {
+		// every worker list the workflows of the cluster with their owner on the ring
+		all, err := h.latestWorkflows()
+		if err != nil {
+			c.Logger().Errorf("cannot list the workflows: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		for _, w := range all {
+			r := res{ID: w.ID, AID: w.AccountID, Name: w.Name, Worker: h.ringOwner(w.ID.String()), Paused: !w.Enabled}
+			if r.Worker == h.workerName && w.Enabled {
+				stats := h.outputs.workflowStats(w.ID.String())
+				r.Outputs = &stats
+			}
+			ws = append(ws, r)
+		}
+		return c.JSON(http.StatusOK, ws)
+	}
+
 	h.sensorLock.RLock()
 	for _, w := range h.workflows {
-		ws = append(ws, res{ID: w.graph.ID, AID: w.graph.AID, Name: w.graph.Name})
+		stats := h.outputs.workflowStats(w.graph.ID.String())
+		ws = append(ws, res{ID: w.graph.ID, AID: w.graph.AID, Name: w.graph.Name, Worker: h.workerName, Outputs: &stats})
+	}
+	for _, w := range h.paused {
+		ws = append(ws, res{ID: w.ID, AID: w.AccountID, Name: w.Name, Worker: h.workerName, Paused: true})
 	}
 	h.sensorLock.RUnlock()
 	return c.JSON(http.StatusOK, ws)
 }
 
+// latestWorkflows return the latest version of the workflows which are not in the trash
+func (h *handler) latestWorkflows() ([]dbWorkflow, error) {
+	query := `SELECT ` + workflowColumns + `
+	FROM workflow JOIN (
+		SELECT id as maxid, MAX(revision) as maxr
+		FROM workflow
+		GROUP BY maxid
+	) w
+	ON w.maxr = revision AND w.maxid = id
+	WHERE deleted_at IS NULL
+	ORDER BY account_id, id;`
+	rows, err := h.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ws []dbWorkflow
+	for rows.Next() {
+		w, err := scanWorkflow(rows)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, rows.Err()
+}
+
 func (h *handler) getRunningWorkflowDebug(c echo.Context) error {
+	type res struct {
+		ID    uuid.UUID                     `json:"id"`
+		AID   uuid.UUID                     `json:"account_id"`
+		Name  string                        `json:"name"`
+		Flow  map[string]*workflow.FlowNode `json:"flow"`
+		State workflow.Snapshot             `json:"state"`
+	}
 	h.sensorLock.RLock()
 	defer h.sensorLock.RUnlock()
-	var res []*workflow.FlowGraph
+	var ws []res
 	for _, w := range h.workflows {
-		res = append(res, w.graph)
+		// the flow is only read for its definition, the runtime state come from the snapshot
+		ws = append(ws, res{ID: w.graph.ID, AID: w.graph.AID, Name: w.graph.Name, Flow: w.graph.Clone().Flow, State: w.graph.Snapshot()})
 	}
-	return c.JSON(http.StatusOK, res)
+	return c.JSON(http.StatusOK, ws)
 }
 
 func (h *handler) getRunningWorkflowDebugDot(c echo.Context) error {
@@ -228,3 +576,108 @@ d3.select("#graph").graphviz()
 
 	return c.HTML(http.StatusOK, buf.String())
 }
+
+// runningWorkflow return the running workflow of the account
+func (h *handler) runningWorkflow(c echo.Context) (*Workflow, bool) {
+	account := c.Get("account").(auth.Account)
+	h.sensorLock.RLock()
+	defer h.sensorLock.RUnlock()
+	w, found := h.workflows[c.Param("id")]
+	if !found || w.graph.AID != account.ID {
+		return nil, false
+	}
+	return w, true
+}
+
+// startRecording of the sensor traffic of a running workflow.
+// The size query parameter bound the number of recorded messages, default to RECORD_SIZE.
+func (h *handler) startRecording(c echo.Context) error {
+	w, found := h.runningWorkflow(c)
+	if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	size := viper.GetInt("RECORD_SIZE")
+	if s := c.QueryParam("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size < 1 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": "invalid size"})
+		}
+	}
+	w.setRecorder(workflow.NewRecorder(size))
+	return c.NoContent(http.StatusOK)
+}
+
+func (h *handler) getRecording(c echo.Context) error {
+	w, found := h.runningWorkflow(c)
+	if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	rec := w.recorder()
+	if rec == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, rec.Recording())
+}
+
+func (h *handler) stopRecording(c echo.Context) error {
+	w, found := h.runningWorkflow(c)
+	if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	w.setRecorder(nil)
+	return c.NoContent(http.StatusOK)
+}
+
+// postReplay feed the recording of a running workflow to a candidate graph
+// and diff the outputs with the published ones.
+// Without a graph in the body, the current graph of the workflow is used.
+func (h *handler) postReplay(c echo.Context) error {
+	w, found := h.runningWorkflow(c)
+	if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	rec := w.recorder()
+	if rec == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"message": "workflow is not recorded"})
+	}
+
+	var req struct {
+		Graph json.RawMessage `json:"graph"`
+	}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
+	}
+	graph := w.graph.Clone()
+	if len(req.Graph) > 0 {
+		var err error
+		graph, err = newFlowGraph(dbWorkflow{ID: graph.ID, AccountID: graph.AID, Name: graph.Name, Graph: req.Graph})
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+		}
+	}
+
+	res, err := workflow.Replay(graph, rec.Recording())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// getExplain return the lineage of the last change of an output, by its node key, its sensor id or its name
+func (h *handler) getExplain(c echo.Context) error {
+	w, found := h.runningWorkflow(c)
+	if !found {
+		return c.NoContent(http.StatusNotFound)
+	}
+	e, err := w.graph.Explain(c.Param("output"))
+	if err == workflow.ErrNoExplanation {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	return c.JSON(http.StatusOK, e)
+}
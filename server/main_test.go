@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// newMemoryHandler run the handler of worker w0 on the memory transport.
+// The database is a stub failing every query, the state of the workflows is neither loaded nor saved.
+func newMemoryHandler(t *testing.T) (*handler, *memoryTransport) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := newMemoryTransport()
+	h := newHandler(handlerConfig{WorkerName: "w0", StreamHistory: 10, OutputBuffer: 16, OutputMandatory: true}, db, mt)
+	go mt.ConsumeCommands(h.handleIncomingCommand)
+	return h, mt
+}
+
+// get the endpoint with the account authenticated, the response is decoded in v
+func get(t *testing.T, path string, handle echo.HandlerFunc, url string, account auth.Account, v interface{}) int {
+	e := echo.New()
+	e.GET(path, handle, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("account", account)
+			return next(c)
+		}
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Code
+}
+
+func TestHandlerCommands(t *testing.T) {
+	h, mt := newMemoryHandler(t)
+	graph := testGraph(t)
+	aid, wid := graph.AID, graph.ID
+	flow, err := json.Marshal(graph.Flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := dbWorkflow{ID: wid, AccountID: aid, Name: graph.Name, Worker: h.workerName, Graph: flow, Enabled: true}
+	account := auth.Account{ID: aid}
+	type running struct {
+		ID      string        `json:"id"`
+		Paused  bool          `json:"paused"`
+		Outputs *publishStats `json:"outputs"`
+	}
+
+	isRunning := func() bool {
+		h.sensorLock.RLock()
+		defer h.sensorLock.RUnlock()
+		_, running := h.workflows[wid.String()]
+		return running
+	}
+
+	// start
+	if err := h.sendStarCommand(w); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, isRunning)
+
+	// the outputs are published and streamed
+	s, _ := h.stream.subscribe(aid.String(), wid.String(), 0)
+	defer h.stream.unsubscribe(s)
+	mt.PublishSensor(Message{RoutingKey: aid.String() + "." + sensorID, Body: temperature(25)})
+	select {
+	case e := <-s.events:
+		var out map[string]interface{}
+		if err := json.Unmarshal(e.Body, &out); err != nil {
+			t.Fatal(err)
+		}
+		if e.RoutingKey != aid.String()+"."+outputID || out["hot"] != true {
+			t.Errorf("wrong streamed output %s %s", e.RoutingKey, e.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the output should be streamed")
+	}
+
+	var ws []running
+	if code := get(t, "/workflow/running", h.getRunningWorkflow, "/workflow/running", account, &ws); code != http.StatusOK {
+		t.Fatalf("running: status %d", code)
+	}
+	if len(ws) != 1 || ws[0].ID != wid.String() || ws[0].Paused || ws[0].Outputs == nil || ws[0].Outputs.Published != 1 {
+		t.Errorf("wrong running workflows %+v", ws)
+	}
+
+	path, url := "/workflow/running/:id/explain/:output", "/workflow/running/"+wid.String()+"/explain/hot"
+	if code := get(t, path, h.getExplain, url, account, nil); code != http.StatusOK {
+		t.Errorf("explain: status %d", code)
+	}
+	if code := get(t, path, h.getExplain, url, auth.Account{}, nil); code != http.StatusNotFound {
+		t.Errorf("explain of another account: status %d", code)
+	}
+
+	// pause
+	if err := h.sendCommand(w, "pause"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !isRunning() })
+	ws = nil
+	get(t, "/workflow/running", h.getRunningWorkflow, "/workflow/running", account, &ws)
+	if len(ws) != 1 || !ws[0].Paused || ws[0].Outputs != nil {
+		t.Errorf("the workflow should be paused, got %+v", ws)
+	}
+	if code := get(t, path, h.getExplain, url, account, nil); code != http.StatusNotFound {
+		t.Errorf("explain of a paused workflow: status %d", code)
+	}
+
+	// stop
+	if err := h.sendStopCommand(aid.String(), wid.String()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return !h.isLocal(wid.String()) })
+	ws = nil
+	get(t, "/workflow/running", h.getRunningWorkflow, "/workflow/running", account, &ws)
+	if len(ws) != 0 {
+		t.Errorf("the workflow should be stopped, got %+v", ws)
+	}
+}
+
+func TestAccountDeletedRequeue(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	h := newHandler(handlerConfig{WorkerName: "w0"}, db, newMemoryTransport())
+	aid := uuid.Must(uuid.NewV4())
+
+	// the deletion is retried when the workflows of the account cannot be found
+	mock.ExpectQuery("SELECT DISTINCT id FROM workflow").WithArgs(aid).WillReturnError(errors.New("connection refused"))
+	a := &countAcker{}
+	h.handleAccountDeleted(Delivery{Message: Message{RoutingKey: aid.String() + ".deleted"}, acker: a})
+	if a.acks != 0 || a.rejects != 1 {
+		t.Errorf("the delivery should be requeued, got %d acks %d rejects", a.acks, a.rejects)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the buckets in seconds of the latency histograms
+var (
+	defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	computeBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, 1}
+)
+
+// workflowLabels label the per-workflow series
+var workflowLabels = []string{"account_id", "workflow_id"}
+
+// webhookResults are the values of the result label of webhookRequests
+var webhookResults = []string{"success", "failure", "dropped"}
+
+// the metrics of the engine, the per-workflow series are labelled with workflowLabels
+var (
+	sensorReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_sensor_messages_received_total",
+		Help: "Sensor messages received by the workflow.",
+	}, workflowLabels)
+	sensorAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_sensor_messages_accepted_total",
+		Help: "Sensor messages used by the workflow.",
+	}, workflowLabels)
+	sensorRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_sensor_messages_rejected_total",
+		Help: "Sensor messages the workflow cannot use, they are dead lettered.",
+	}, workflowLabels)
+	computeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "workflow_compute_duration_seconds",
+		Help:    "Duration of the computation of the graph.",
+		Buckets: computeBuckets,
+	}, workflowLabels)
+	outputsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_outputs_published_total",
+		Help: "Output messages buffered to be published.",
+	}, workflowLabels)
+	outputsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_outputs_dropped_total",
+		Help: "Output messages dropped because the output buffer was full.",
+	}, workflowLabels)
+	webhookRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "workflow_webhook_requests_total",
+		Help: "Webhook requests by result, success, failure or dropped.",
+	}, append(workflowLabels, "result"))
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "workflow_webhook_duration_seconds",
+		Help:    "Duration of the webhook requests.",
+		Buckets: defaultBuckets,
+	}, workflowLabels)
+	deadLetters = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "workflow_sensor_dead_letters_total",
+		Help: "Sensor messages published on the dead letter exchange.",
+	})
+	amqpReconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "workflow_amqp_reconnects_total",
+		Help: "Connections to RabbitMQ opened again after being lost.",
+	})
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "workflow_db_query_duration_seconds",
+		Help:    "Duration of the PostgreSQL queries by statement, e.g. select or insert.",
+		Buckets: defaultBuckets,
+	}, []string{"statement"})
+
+	// workflowMetrics have a series by workflow, deleted when the workflow stops
+	workflowMetrics = []interface{ DeleteLabelValues(...string) bool }{
+		sensorReceived, sensorAccepted, sensorRejected, computeDuration,
+		outputsPublished, outputsDropped, webhookDuration,
+	}
+)
+
+// newMetricsRegistry register the metrics of the engine and the running workflows of the handler
+func newMetricsRegistry(h *handler) *prometheus.Registry {
+	r := prometheus.NewRegistry()
+	r.MustRegister(
+		sensorReceived, sensorAccepted, sensorRejected, computeDuration,
+		outputsPublished, outputsDropped, webhookRequests, webhookDuration,
+		deadLetters, amqpReconnects, dbDuration,
+		runningWorkflows{h},
+	)
+	return r
+}
+
+// since observe the duration since start in seconds
+func since(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// forgetWorkflowMetrics delete the series of a workflow no longer running on the worker
+func forgetWorkflowMetrics(aid, wid string) {
+	for _, m := range workflowMetrics {
+		m.DeleteLabelValues(aid, wid)
+	}
+	for _, result := range webhookResults {
+		webhookRequests.DeleteLabelValues(aid, wid, result)
+	}
+}
+
+// runningWorkflowsDesc is the gauge of the running workflows by account
+var runningWorkflowsDesc = prometheus.NewDesc("workflow_running_workflows",
+	"Workflows running on the worker by account.", []string{"account_id"}, nil)
+
+// runningWorkflows collect the running workflows of the handler when scraped
+type runningWorkflows struct {
+	h *handler
+}
+
+func (c runningWorkflows) Describe(ch chan<- *prometheus.Desc) {
+	ch <- runningWorkflowsDesc
+}
+
+func (c runningWorkflows) Collect(ch chan<- prometheus.Metric) {
+	counts := make(map[string]int)
+	c.h.sensorLock.RLock()
+	for _, wo := range c.h.workflows {
+		counts[wo.graph.AID.String()]++
+	}
+	c.h.sensorLock.RUnlock()
+	for aid, n := range counts {
+		ch <- prometheus.MustNewConstMetric(runningWorkflowsDesc, prometheus.GaugeValue, float64(n), aid)
+	}
+}
+
+// timedConnector open the connections to PostgreSQL measuring the duration of the queries
+type timedConnector struct {
+	driver.Connector
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{conn}, nil
+}
+
+// timedConn observe the duration of the queries until their rows or result are returned.
+// The driver must implement the context interfaces of database/sql.
+type timedConn struct {
+	driver.Conn
+}
+
+// statement return the first keyword of the query in lower case
+func statement(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(fields[0], ";"))
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer since(dbDuration.WithLabelValues(statement(query)), time.Now())
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer since(dbDuration.WithLabelValues(statement(query)), time.Now())
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c timedConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	workflow "github.com/fredericalix/yic_workflow-engine"
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRunningWorkflowsMetric(t *testing.T) {
+	a1, a2 := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	h := &handler{workflows: map[string]*Workflow{
+		"w1": {graph: &workflow.FlowGraph{AID: a1}},
+		"w2": {graph: &workflow.FlowGraph{AID: a1}},
+		"w3": {graph: &workflow.FlowGraph{AID: a2}},
+	}}
+	e := echo.New()
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(newMetricsRegistry(h), promhttp.HandlerOpts{})))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	got := rec.Body.String()
+	for _, line := range []string{
+		`workflow_running_workflows{account_id="` + a1.String() + `"} 2`,
+		`workflow_running_workflows{account_id="` + a2.String() + `"} 1`,
+		`# TYPE workflow_running_workflows gauge`,
+		`workflow_amqp_reconnects_total 0`,
+	} {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing %s in\n%s", line, got)
+		}
+	}
+}
+
+func TestWorkflowMetrics(t *testing.T) {
+	graph := testGraph(t)
+	aid, wid := graph.AID.String(), graph.ID.String()
+	wo, mt, pub := startTestWorkflow(t, graph, testHooks)
+
+	mt.PublishSensor(Message{RoutingKey: aid + "." + sensorID, Body: temperature(25)})
+	mt.PublishSensor(Message{RoutingKey: aid + "." + sensorID, Body: []byte("not json")})
+	waitFor(t, func() bool { return len(mt.DeadLetters()) > 0 && pub.workflowStats(wid).Confirmed > 0 })
+	for c, expected := range map[*prometheus.CounterVec]float64{sensorReceived: 2, sensorAccepted: 1, sensorRejected: 1, outputsPublished: 1} {
+		if v := testutil.ToFloat64(c.WithLabelValues(aid, wid)); v != expected {
+			t.Errorf("%s: expected %v got %v", c.WithLabelValues(aid, wid).Desc(), expected, v)
+		}
+	}
+
+	// the series are deleted once the workflow stops
+	wo.Stop()
+	webhookRequests.WithLabelValues(aid, wid, "failure").Inc()
+	forgetWorkflowMetrics(aid, wid)
+	for _, m := range workflowMetrics {
+		if m.DeleteLabelValues(aid, wid) {
+			t.Errorf("the series of %T should be deleted", m)
+		}
+	}
+	if webhookRequests.DeleteLabelValues(aid, wid, "failure") {
+		t.Error("the webhook series should be deleted")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT broker forwarding the messages with QoS 0,
+// the shared subscriptions are handled as plain subscriptions
+type testBroker struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	clients map[*testBrokerClient]bool
+}
+
+type testBrokerClient struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	filters []string
+}
+
+func (c *testBrokerClient) write(p packets.ControlPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.Write(c.conn)
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{ln: ln, clients: make(map[*testBrokerClient]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&testBrokerClient{conn: conn})
+		}
+	}()
+	return b
+}
+
+func (b *testBroker) subscriptions() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for c := range b.clients {
+		c.mu.Lock()
+		n += len(c.filters)
+		c.mu.Unlock()
+	}
+	return n
+}
+
+func (b *testBroker) serve(c *testBrokerClient) {
+	b.mu.Lock()
+	b.clients[c] = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.clients, c)
+		b.mu.Unlock()
+		c.conn.Close()
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(c.conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			c.write(packets.NewControlPacket(packets.Connack))
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = make([]byte, len(p.Topics))
+			c.mu.Lock()
+			for _, f := range p.Topics {
+				if strings.HasPrefix(f, "$share/") {
+					f = strings.SplitN(f, "/", 3)[2]
+				}
+				c.filters = append(c.filters, f)
+			}
+			c.mu.Unlock()
+			c.write(ack)
+		case *packets.PublishPacket:
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.write(ack)
+			}
+			b.forward(p.TopicName, p.Payload)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *testBroker) forward(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		c.mu.Lock()
+		match := false
+		for _, f := range c.filters {
+			match = match || topicMatch(f, topic)
+		}
+		c.mu.Unlock()
+		if match {
+			p := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+			p.TopicName = topic
+			p.Payload = payload
+			c.write(p)
+		}
+	}
+}
+
+// topicMatch return true if the topic match the filter with the + and # wildcards
+func topicMatch(filter, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+		if i >= len(t) || (f[i] != "+" && f[i] != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+func TestMQTTBridge(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.ln.Close()
+	uri := "tcp://" + broker.ln.Addr().String()
+
+	mt := newMemoryTransport()
+	config := mqttConfig{URI: uri, ClientID: "w0", SensorTopic: "sensors", OutputTopic: "sensors", QoS: 1}
+	if _, err := newMQTTBridge(config, mt); err == nil {
+		t.Errorf("the same sensor and output topics should be refused")
+	}
+	config.OutputTopic, config.SharedGroup = "outputs", "engine"
+	// the first publications on the transport fail
+	ft := &flakyTransport{Transport: mt, failures: 2}
+	b, err := newMQTTBridge(config, ft)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.client.Disconnect(0)
+	waitFor(t, func() bool { return broker.subscriptions() == 1 })
+
+	device := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(uri).SetClientID("device"))
+	if token := device.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer device.Disconnect(0)
+	outputs := make(chan mqtt.Message, 1)
+	token := device.Subscribe("outputs/#", 1, func(_ mqtt.Client, m mqtt.Message) { outputs <- m })
+	if token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	// the device message is forwarded to the sensor with a created_at, once the transport accept it
+	sensors := mt.Watch("aid.sid")
+	device.Publish("sensors/aid/sid", 1, false, `{"temperature": 25}`).Wait()
+	select {
+	case m := <-sensors:
+		var data map[string]interface{}
+		if err := json.Unmarshal(m.Body, &data); err != nil {
+			t.Fatal(err)
+		}
+		if data["temperature"] != 25.0 || data["created_at"] == nil || m.Headers["mqtt_topic"] != "sensors/aid/sid" {
+			t.Errorf("wrong sensor message %s %v", m.Body, m.Headers)
+		}
+		if n := ft.attempts(); n != 3 {
+			t.Errorf("expected 3 attempts, got %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the MQTT message was not forwarded")
+	}
+
+	// a message the transport refuses maxForwardAttempts times is dropped, the next ones are forwarded
+	ft.mu.Lock()
+	ft.failures = maxForwardAttempts
+	ft.mu.Unlock()
+	device.Publish("sensors/aid/sid", 1, false, `{"temperature": 26}`).Wait()
+	device.Publish("sensors/aid/sid", 1, false, `{"temperature": 27}`).Wait()
+	select {
+	case m := <-sensors:
+		if !strings.Contains(string(m.Body), `"temperature":27`) {
+			t.Errorf("the message should be dropped, got %s", m.Body)
+		}
+		if n := ft.attempts(); n != 3+maxForwardAttempts+1 {
+			t.Errorf("expected %d attempts, got %d", 3+maxForwardAttempts+1, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the next MQTT message was not forwarded")
+	}
+
+	// the output messages are published on MQTT
+	b.publish("aid", "out", []byte(`{"hot": true}`))
+	select {
+	case m := <-outputs:
+		if m.Topic() != "outputs/aid/out" || string(m.Payload()) != `{"hot": true}` {
+			t.Errorf("wrong output %s %s", m.Topic(), m.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the output was not published on MQTT")
+	}
+}
+
+// flakyTransport fail the first publications of the sensor messages
+type flakyTransport struct {
+	Transport
+	mu       sync.Mutex
+	failures int
+	calls    int
+}
+
+func (t *flakyTransport) PublishSensor(m Message) error {
+	t.mu.Lock()
+	t.calls++
+	fail := t.failures > 0
+	t.failures--
+	t.mu.Unlock()
+	if fail {
+		return errors.New("disconnected")
+	}
+	return t.Transport.PublishSensor(m)
+}
+
+func (t *flakyTransport) attempts() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+func TestMQTTWarnUnshared(t *testing.T) {
+	b := &mqttBridge{}
+	b.warnUnshared([]workerInfo{{Name: "w0", Alive: true}, {Name: "w1"}})
+	if b.warned {
+		t.Error("a single alive worker should not be reported")
+	}
+	b.warnUnshared([]workerInfo{{Name: "w0", Alive: true}, {Name: "w1", Alive: true}})
+	if !b.warned {
+		t.Error("several alive workers without shared group should be reported")
+	}
+	b = &mqttBridge{config: mqttConfig{SharedGroup: "engine"}}
+	b.warnUnshared([]workerInfo{{Name: "w0", Alive: true}, {Name: "w1", Alive: true}})
+	if b.warned {
+		t.Error("the workers of a shared group should not be reported")
+	}
+}
+
+func TestWithCreatedAt(t *testing.T) {
+	now := time.Date(2019, 10, 1, 12, 0, 0, 0, time.UTC)
+	for payload, expected := range map[string]string{
+		`{"v": 1}`: `{"created_at":"2019-10-01T12:00:00Z","v":1}`,
+		`{"created_at": "2019-01-01T00:00:00Z", "v": 1}`: `{"created_at": "2019-01-01T00:00:00Z", "v": 1}`,
+		`not json`: `not json`,
+		`[1, 2]`:   `[1, 2]`,
+	} {
+		if got := string(withCreatedAt([]byte(payload), now)); got != expected {
+			t.Errorf("%s: expected %s got %s", payload, expected, got)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxInFlight is the maximum number of output messages published and not confirmed yet
+const maxInFlight = 256
+
+var errBufferFull = errors.New("output buffer full")
+
+// outputMessage is an output message of a workflow to publish on the sensors exchange
+type outputMessage struct {
+	WID        string
+	RoutingKey string
+	Body       []byte
+	Timestamp  string
+	attempts   int
+	id         string     // the id of the CloudEvents, the same on each attempt
+	span       trace.Span // the span of the publication, ended once confirmed
+	// confirmed is called once the message is confirmed by the broker, or with the error when it is dropped
+	confirmed func(err error)
+}
+
+// settle the message confirmed, or dropped with err
+func (m *outputMessage) settle(err error) {
+	failSpan(m.span, err)
+	m.span.End()
+	if m.confirmed != nil {
+		m.confirmed(err)
+	}
+}
+
+// publishStats count the output messages of a workflow
+type publishStats struct {
+	Published int `json:"published"`
+	Confirmed int `json:"confirmed"`
+	// Unconfirmed are the messages buffered or waiting for the confirmation of the broker
+	Unconfirmed int `json:"unconfirmed"`
+	// Failed are the messages dropped because the buffer was full or they could not be encoded
+	Failed int `json:"failed"`
+	// Returned are the mandatory messages not routed to any queue
+	Returned int `json:"returned"`
+}
+
+// outputPublisher publish the output messages in confirm mode.
+// The messages are buffered until published, those not confirmed when the channel is closed
+// and those rejected by the broker are kept in the retry buffer and published again until confirmed.
+type outputPublisher struct {
+	transport   Transport
+	mandatory   bool
+	cloudEvents string // binary or structured to publish the messages as CloudEvents
+	queue       chan *outputMessage
+
+	mu    sync.Mutex
+	stats map[string]*publishStats
+
+	// retry are the messages to publish again first, only used by run
+	retry []*outputMessage
+}
+
+// newOutputPublisher buffering at most size messages, run must be called to publish them.
+// With mandatory, the messages not routed to any queue are counted as returned.
+// With cloudEvents binary or structured, the messages are published as CloudEvents.
+func newOutputPublisher(t Transport, size int, mandatory bool, cloudEvents string) *outputPublisher {
+	if size < 1 {
+		size = 1
+	}
+	return &outputPublisher{
+		transport:   t,
+		mandatory:   mandatory,
+		cloudEvents: cloudEvents,
+		queue:       make(chan *outputMessage, size),
+		stats:       make(map[string]*publishStats),
+	}
+}
+
+// update the stats of the workflow, p.mu must not be held.
+// The stats are created by publish, the messages of a forgotten workflow are not counted anymore.
+func (p *outputPublisher) update(wid string, f func(s *publishStats)) {
+	p.mu.Lock()
+	if s, exist := p.stats[wid]; exist {
+		f(s)
+	}
+	p.mu.Unlock()
+}
+
+// forget the stats of a workflow no longer running on the worker
+func (p *outputPublisher) forget(wid string) {
+	p.mu.Lock()
+	delete(p.stats, wid)
+	p.mu.Unlock()
+}
+
+// publish buffer the message, errBufferFull is returned if the buffer is full.
+// confirmed is only called for the buffered messages.
+func (p *outputPublisher) publish(m outputMessage) error {
+	m.id = uuid.Must(uuid.NewV4()).String()
+	if m.span == nil {
+		m.span = trace.SpanFromContext(context.Background())
+	}
+	p.mu.Lock()
+	if _, exist := p.stats[m.WID]; !exist {
+		p.stats[m.WID] = &publishStats{}
+	}
+	p.mu.Unlock()
+	select {
+	case p.queue <- &m:
+		p.update(m.WID, func(s *publishStats) { s.Unconfirmed++ })
+		return nil
+	default:
+		p.update(m.WID, func(s *publishStats) { s.Failed++ })
+		failSpan(m.span, errBufferFull)
+		m.span.End()
+		return errBufferFull
+	}
+}
+
+// message to publish for the output message
+func (p *outputPublisher) message(m *outputMessage) (Message, error) {
+	msg := Message{
+		RoutingKey:  m.RoutingKey,
+		Headers:     map[string]interface{}{"timestamp": m.Timestamp},
+		ContentType: "application/json",
+		MessageID:   m.WID,
+		Body:        m.Body,
+	}
+	injectSpan(m.span, msg.Headers)
+	if p.cloudEvents == "" {
+		return msg, nil
+	}
+	rk := strings.SplitN(m.RoutingKey, ".", 2)
+	if len(rk) < 2 {
+		return msg, fmt.Errorf("invalid routing key %s", m.RoutingKey)
+	}
+	return encodeCloudEvent(msg, p.cloudEvents, m.id, rk[0], m.WID, rk[1], m.Timestamp)
+}
+
+// workflowStats return the stats of the workflow
+func (p *outputPublisher) workflowStats(wid string) publishStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s, exist := p.stats[wid]; exist {
+		return *s
+	}
+	return publishStats{}
+}
+
+// run publish the buffered messages, a new session is opened after each error
+func (p *outputPublisher) run() {
+	for {
+		s, err := p.transport.OpenOutputs()
+		if err == nil {
+			err = p.session(s)
+			s.Close()
+		}
+		if err != nil {
+			log.Printf("cannot publish the output messages: %v", err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// session publish the messages until the session is closed
+func (p *outputPublisher) session(s OutputSession) error {
+	confirms, returns, closed := s.Confirms(), s.Returns(), s.Closed()
+
+	pending := make(map[uint64]*outputMessage)
+	// keep the unconfirmed messages in order to publish them again on the next session,
+	// the attempt is not counted as the broker did not reject them
+	defer func() {
+		tags := make([]uint64, 0, len(pending))
+		for t := range pending {
+			tags = append(tags, t)
+		}
+		sort.Slice(tags, func(i, j int) bool { return tags[i] < tags[j] })
+		unconfirmed := make([]*outputMessage, 0, len(tags)+len(p.retry))
+		for _, t := range tags {
+			pending[t].attempts--
+			unconfirmed = append(unconfirmed, pending[t])
+		}
+		p.retry = append(unconfirmed, p.retry...)
+	}()
+
+	send := func(m *outputMessage) error {
+		msg, err := p.message(m)
+		if err != nil {
+			log.Printf("drop output %s of %s: %v", m.RoutingKey, m.WID, err)
+			p.update(m.WID, func(s *publishStats) { s.Failed++; s.Unconfirmed-- })
+			m.settle(err)
+			return nil
+		}
+		m.attempts++
+		tag, err := s.Publish(msg, p.mandatory)
+		if err != nil {
+			m.attempts--
+			p.retry = append([]*outputMessage{m}, p.retry...)
+			return err
+		}
+		if m.attempts == 1 {
+			p.update(m.WID, func(s *publishStats) { s.Published++ })
+		}
+		pending[tag] = m
+		return nil
+	}
+
+	for {
+		for len(p.retry) > 0 && len(pending) < maxInFlight {
+			m := p.retry[0]
+			p.retry = p.retry[1:]
+			if err := send(m); err != nil {
+				return err
+			}
+		}
+
+		queue := p.queue
+		if len(pending) >= maxInFlight || len(p.retry) > 0 {
+			queue = nil
+		}
+		select {
+		case m := <-queue:
+			if err := send(m); err != nil {
+				return err
+			}
+
+		case c, ok := <-confirms:
+			if !ok {
+				return errors.New("channel closed")
+			}
+			m, exist := pending[c.Tag]
+			if !exist {
+				continue
+			}
+			delete(pending, c.Tag)
+			switch {
+			case c.Ack:
+				p.update(m.WID, func(s *publishStats) { s.Confirmed++; s.Unconfirmed-- })
+				m.span.SetAttributes(attribute.Int("messaging.attempts", m.attempts))
+				m.settle(nil)
+			default:
+				p.retry = append(p.retry, m)
+			}
+
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			log.Printf("output %s of %s not routed: %s", r.RoutingKey, r.MessageID, r.Reason)
+			p.update(r.MessageID, func(s *publishStats) { s.Returned++ })
+
+		case err := <-closed:
+			return fmt.Errorf("session closed: %v", err)
+		}
+	}
+}
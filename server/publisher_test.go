@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutputPublisherBuffer(t *testing.T) {
+	// not running, the messages stay in the buffer
+	p := newOutputPublisher(nil, 2, false, "")
+	for i := 0; i < 3; i++ {
+		err := p.publish(outputMessage{WID: "w", RoutingKey: "a.s", Body: []byte("{}")})
+		if i < 2 && err != nil {
+			t.Errorf("message %d: %v", i, err)
+		}
+		if i == 2 && err != errBufferFull {
+			t.Errorf("expected %v got %v", errBufferFull, err)
+		}
+	}
+	s := p.workflowStats("w")
+	if s.Unconfirmed != 2 || s.Failed != 1 || s.Published != 0 {
+		t.Errorf("wrong stats %+v", s)
+	}
+	if s := p.workflowStats("other"); s != (publishStats{}) {
+		t.Errorf("unknown workflow should have empty stats, got %+v", s)
+	}
+}
+
+func TestOutputPublisherConfirmed(t *testing.T) {
+	p := newOutputPublisher(newMemoryTransport(), 2, false, "")
+	go p.run()
+	confirmed := make(chan error, 1)
+	err := p.publish(outputMessage{WID: "w", RoutingKey: "a.s", Body: []byte("{}"), confirmed: func(err error) { confirmed <- err }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-confirmed:
+		if err != nil {
+			t.Errorf("the message should be confirmed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message is not confirmed")
+	}
+	if s := p.workflowStats("w"); s.Confirmed != 1 {
+		t.Errorf("wrong stats %+v", s)
+	}
+
+	// the stats of a stopped workflow are removed
+	p.forget("w")
+	if s := p.workflowStats("w"); s != (publishStats{}) {
+		t.Errorf("the stats should be removed, got %+v", s)
+	}
+}
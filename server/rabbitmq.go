@@ -1,20 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	workflow "github.com/fredericalix/yic_workflow-engine"
 	"github.com/gofrs/uuid"
-	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func randName(l int) []byte {
@@ -28,528 +27,399 @@ func randName(l int) []byte {
 
 // Workflow ampq handler
 type Workflow struct {
-	graph  *workflow.FlowGraph
-	ch     *amqp.Channel
-	sch    *amqp.Channel
-	closed chan struct{}
+	graph     *workflow.FlowGraph
+	transport Transport
+	router    *sensorRouter
+	pub       *outputPublisher
+	inbox     *mailbox
+	closed    chan struct{}
+	done      chan struct{}
+	hooks     workflowHooks
+
+	mu  sync.Mutex
+	rec *workflow.Recorder
 }
 
-// Stop the workflow
-func (w Workflow) Stop() {
-	w.ch.Close()
-	w.sch.Close()
-	w.closed <- struct{}{}
+// recorder return the recorder of the sensor traffic, nil if the workflow is not recorded
+func (w *Workflow) recorder() *workflow.Recorder {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.rec
 }
 
-func newWorkflow(conn *amqp.Connection, w *workflow.FlowGraph, workerName string) (*Workflow, error) {
-	var err error
+// setRecorder start the recording of the sensor traffic, a nil recorder stop it
+func (w *Workflow) setRecorder(rec *workflow.Recorder) {
+	w.mu.Lock()
+	w.rec = rec
+	w.mu.Unlock()
+}
+
+// Stop the workflow, wait the end of the processing of the current message.
+// The messages left in the inbox are released without being processed.
+func (w *Workflow) Stop() {
+	close(w.closed)
+	w.router.remove(w)
+	<-w.done
+	for _, d := range w.inbox.close() {
+		d.done(w.graph.ID.String(), nil)
+	}
+}
+
+// explainOutputs attach the explanation of the changes to the published output messages
+var explainOutputs bool
+
+// snapshotInterval is the period of the persistence of the runtime state of the workflows
+var snapshotInterval = 30 * time.Second
+
+// workflowHooks are called by a running workflow
+type workflowHooks struct {
+	// saveState is called periodically and when stopped with the state of the graph
+	saveState func(workflow.Snapshot)
+	// published is called when an output message is confirmed by the broker, from the publisher goroutine
+	published func(sid string, out map[string]interface{}, body []byte)
+	// webhook is called to send the output message to the webhook of the output sensor, s is the span of the delivery
+	webhook func(sid, url string, body []byte, s trace.Span)
+}
+
+// newWorkflow build the graph and add it to the receivers of its sensors, the messages are queued until run is called.
+func newWorkflow(t Transport, router *sensorRouter, pub *outputPublisher, w *workflow.FlowGraph, hooks workflowHooks) (*Workflow, error) {
 	wo := &Workflow{
-		graph:  w,
-		closed: make(chan struct{}),
+		graph:     w,
+		transport: t,
+		router:    router,
+		pub:       pub,
+		inbox:     newMailbox(),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+		hooks:     hooks,
 	}
-	err = wo.graph.Build()
+	err := wo.graph.Build()
 	if err != nil {
 		return nil, err
 	}
+	router.add(wo)
+	return wo, nil
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
-	oldSensors, err := findLatestSensors(ctx, conn, w.AID, "")
-	if err != nil {
-		log.Printf("could not find latest sensors messages: %v\n", err)
-	}
-
-	ch, err := conn.Channel()
-	wo.ch = ch
-	failOnError(err, "Failed to open a channel")
-
-	err = ch.ExchangeDeclare(
-		"sensors", // name
-		"topic",   // type
-		true,      // durable
-		false,     // auto-deleted
-		false,     // internal
-		false,     // no-wait
-		nil,       // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-
-	qname := fmt.Sprintf("%s_%s_%s_%s", workerName, w.AID, w.ID, randName(6))
-	q, err := ch.QueueDeclare(
-		qname, // name
-		false, // durable
-		true,  // delete when usused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	msgs, err := ch.Consume(
-		q.Name,     // queue
-		workerName, // consumer
-		true,       // auto ack
-		false,      // exclusive
-		false,      // no local
-		false,      // no wait
-		nil,        // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	// Only bind input sensor to the queue
-	for sensorID := range w.Inputs {
-		key := fmt.Sprintf("%s.%s", w.AID, sensorID)
-		err := ch.QueueBind(
-			q.Name,    // queue name
-			key,       // routing key
-			"sensors", // exchange
-			false,     // no wait
-			nil,       // args
-		)
+// run restore the graph from state if not nil and start to process the sensor messages.
+// The workflow must be stopped even if it cannot run, to release its queued messages.
+func (wo *Workflow) run(state *workflow.Snapshot) error {
+	w := wo.graph
+	if state != nil {
+		n, err := w.Restore(*state)
 		if err != nil {
-			log.Println(err)
-			continue
+			close(wo.done)
+			return err
 		}
-		log.Printf("For %s bind to %s\n", w.ID, key)
+		log.Printf("restore %d nodes of workflow %v %v", n, w.AID, w.ID)
 	}
 
-	senbSensor, err := conn.Channel()
-	wo.sch = senbSensor
-	failOnError(err, "Failed to open sendSensor channel")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	oldSensors, err := wo.transport.LatestSensors(ctx, w.AID)
+	if err != nil {
+		log.Printf("could not find latest sensors messages: %v\n", err)
+	}
 
 	go func() {
+		defer close(wo.done)
+		defer cancel()
 		log.Println("Ready wait for 'sensor' events for", w.AID, w.ID)
+		ticker := time.NewTicker(snapshotInterval)
+		defer ticker.Stop()
+		dirty := false
 		for {
-			var aid, sid string
-			var data map[string]interface{}
+			var routingKey string
+			var body []byte
+			var d *sensorDelivery
 			select {
 			case <-wo.closed:
+				if dirty {
+					wo.hooks.saveState(w.Snapshot())
+				}
 				return
-			case d := <-msgs:
-				rk := strings.Split(d.RoutingKey, ".")
-				aid, sid = rk[0], rk[1]
-
-				err := json.Unmarshal(d.Body, &data)
-				if err != nil {
-					log.Printf("fail to unmarshal sensor body: %v, CORRID=%s", err, d.CorrelationId)
+			case <-ticker.C:
+				if dirty {
+					wo.hooks.saveState(w.Snapshot())
+					dirty = false
+				}
+				continue
+			case <-wo.inbox.ready:
+				if d = wo.inbox.pop(); d == nil {
 					continue
 				}
-			case d := <-oldSensors:
-				var ok bool
-				sid, ok = d["sid"].(string)
-				if !ok {
+				routingKey, body = d.RoutingKey, d.Body
+			case latest := <-oldSensors:
+				sid, ok := latest["sid"].(string)
+				if !ok || sid == "" {
 					continue
 				}
-				aid, ok = d["aid"].(string)
-				if sid == "" {
+				aid, _ := latest["aid"].(string)
+				var err error
+				body, err = json.Marshal(latest["data"])
+				if err != nil {
+					log.Printf("fail to marshal latest sensor %v.%v: %v", aid, sid, err)
 					continue
 				}
-				data = d["data"].(map[string]interface{})
+				routingKey = aid + "." + sid
 			}
 
-			msgTime, ok := data["created_at"].(string)
-			if !ok {
-				log.Printf("missing created_at field in sensors %v.%v\n", aid, sid)
+			computed, err := wo.process(routingKey, body, d)
+			if d != nil {
+				d.done(w.ID.String(), err)
 			}
-			recvTime, err := time.Parse(time.RFC3339Nano, msgTime)
-			if !ok {
-				log.Printf("created_at parsing error in sensors %v.%v: %v\n", aid, sid, err)
+			if computed {
+				dirty = true
 			}
+		}
+	}()
 
-			// the message is not need, nothing to do here
-			recompute, err := w.SendInput(aid, sid, recvTime, data)
-			if err != nil {
-				log.Printf("error in the input sensors %s to workflow %s.%s: %v", sid, aid, w.ID, err)
-				continue
-			}
-			if !recompute {
-				continue
-			}
+	return nil
+}
 
-			// update the graph value
-			w.Compute()
+// process a sensor message, it returns true if the graph was computed again.
+// The errors are about a message the workflow cannot use, it is not sent again.
+// The delivery d, nil for the latest sensor values, is held until the output messages are confirmed.
+// The spans of the stages are children of the span of d, a new trace is started without.
+func (wo *Workflow) process(routingKey string, body []byte, d *sensorDelivery) (bool, error) {
+	w := wo.graph
+	var parent trace.Span
+	if d != nil {
+		parent = d.span
+	}
+	ps := startSpan(parent, "workflow.process", trace.SpanKindInternal,
+		attribute.String("workflow.id", w.ID.String()),
+		attribute.String("workflow.account_id", w.AID.String()),
+		attribute.String("messaging.routing_key", routingKey),
+	)
+	defer ps.End()
+	// the labels of the metrics of the workflow
+	labels := []string{w.AID.String(), w.ID.String()}
+	sensorReceived.WithLabelValues(labels...).Inc()
+	if rec := wo.recorder(); rec != nil {
+		rec.RecordInput(routingKey, body, time.Now())
+	}
 
-			// make a set of message id where at least one of its field has changed
-			changed := make(map[string]struct{})
-			for _, out := range w.Output() {
-				if out.HasChanged() {
-					changed[out.ID] = struct{}{}
-				}
-			}
-			output := make(map[string]map[string]interface{})
-			for _, out := range w.Output() {
-				// only contruct message if its in the changed set of message id
-				if _, mustSend := changed[out.ID]; !mustSend {
-					continue
-				}
-				v, exist := output[out.ID]
-				if !exist {
-					// construct the message
-					v = make(map[string]interface{})
-					v["id"] = out.ID
-					output[out.ID] = v
-				}
-				// append the field to the message
-				v[out.Name] = out.ComputedValue
-			}
+	aid, sid, recvTime, data, err := workflow.DecodeSensorMessage(routingKey, body)
+	if err != nil {
+		log.Printf("fail to decode sensor %v: %v", routingKey, err)
+		sensorRejected.WithLabelValues(labels...).Inc()
+		failSpan(ps, err)
+		return false, err
+	}
 
-			now := time.Now().Format(time.RFC3339Nano)
+	// the message is not need, nothing to do here
+	ss := startSpan(ps, "workflow.send_input", trace.SpanKindInternal)
+	recompute, err := w.SendInput(aid, sid, recvTime, data)
+	ss.SetAttributes(attribute.Bool("workflow.recompute", recompute))
+	failSpan(ss, err)
+	ss.End()
+	if err != nil {
+		log.Printf("error in the input sensors %s to workflow %s.%s: %v", sid, aid, w.ID, err)
+		sensorRejected.WithLabelValues(labels...).Inc()
+		failSpan(ps, err)
+		return false, err
+	}
+	sensorAccepted.WithLabelValues(labels...).Inc()
+	if !recompute {
+		return false, nil
+	}
 
-			// send each output messages
-			for sid, out := range output {
-				out["created_at"] = now
-				body, err := json.Marshal(out)
-				if err != nil {
-					log.Println(err)
-					continue
-				}
+	// update the graph value
+	cs := startSpan(ps, "workflow.compute", trace.SpanKindInternal)
+	start := time.Now()
+	w.Compute()
+	output := w.OutputMessages()
+	since(computeDuration.WithLabelValues(labels...), start)
+	cs.SetAttributes(attribute.Int("workflow.outputs", len(output)))
+	cs.End()
+
+	now := time.Now().Format(time.RFC3339Nano)
+
+	// send each output messages
+	for sid, out := range output {
+		out["created_at"] = now
+		if explainOutputs {
+			out["explain"] = w.OutputExplanations(sid)
+		}
+		body, err := json.Marshal(out)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
 
-				log.Printf("send %v.%v: %s\n", aid, sid, body)
-
-				err = senbSensor.Publish(
-					"sensors",   // exchange
-					aid+"."+sid, // routing key
-					false,       // mandatory
-					false,       // immediate
-					amqp.Publishing{
-						DeliveryMode: amqp.Persistent,
-						// CorrelationId: coorID,
-						Headers:     amqp.Table{"timestamp": now},
-						ContentType: "application/json",
-						Body:        body,
-					})
-				if err != nil {
-					log.Println(err)
-				}
+		log.Printf("send %v.%v: %s\n", aid, sid, body)
 
-				// send webhook if it exist
-				if url, exist := w.Hooks[sid]; exist {
-					go func() {
-						resp, err := http.Post(url, "application/json", bytes.NewReader(body))
-						if err != nil {
-							log.Printf("cannot send webhood for %s.%s: %v\n", aid, sid, err)
-							return
-						}
-						defer resp.Body.Close()
-						if resp.StatusCode/100 != 2 {
-							log.Printf("cannot send webhood for %s.%s: %v\n", aid, sid, resp.Status)
-							return
-						}
-						log.Printf("send webhook %v.%v to %s\n", aid, sid, url)
-					}()
+		pub := startSpan(ps, "output.publish", trace.SpanKindProducer,
+			attribute.String("messaging.destination", "sensors"),
+			attribute.String("messaging.routing_key", aid+"."+sid),
+		)
+		sid, out := sid, out
+		if d != nil {
+			d.hold()
+		}
+		err = wo.pub.publish(outputMessage{
+			WID:        w.ID.String(),
+			RoutingKey: aid + "." + sid,
+			Body:       body,
+			Timestamp:  now,
+			span:       pub,
+			confirmed: func(err error) {
+				if err == nil {
+					wo.hooks.published(sid, out, body)
+				}
+				if d != nil {
+					d.release()
 				}
+			},
+		})
+		if err != nil {
+			log.Printf("cannot publish %v.%v: %v", aid, sid, err)
+			outputsDropped.WithLabelValues(labels...).Inc()
+			if d != nil {
+				d.release()
 			}
+		} else {
+			outputsPublished.WithLabelValues(labels...).Inc()
+		}
+		if rec := wo.recorder(); rec != nil {
+			rec.RecordOutput(aid+"."+sid, body, time.Now())
 		}
-	}()
-
-	return wo, nil
-}
-
-func openCommandChannel(conn *amqp.Connection, name string) *amqp.Channel {
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-
-	err = ch.ExchangeDeclare(
-		"workflow", // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
 
-	return ch
+		// send webhook if it exist
+		if url, exist := w.Hooks[sid]; exist {
+			hs := startSpan(ps, "webhook.send", trace.SpanKindClient,
+				attribute.String("http.method", "POST"),
+				attribute.String("http.url", url),
+			)
+			wo.hooks.webhook(sid, url, body, hs)
+		}
+	}
+	return true, nil
 }
 
-func (h *handler) handleIncomingCommand() {
-	ch, err := h.conn.Channel()
-	failOnError(err, "Failed to open a channel")
-
-	err = ch.ExchangeDeclare(
-		"workflow", // name
-		"topic",    // type
-		true,       // durable
-		false,      // auto-deleted
-		false,      // internal
-		false,      // no-wait
-		nil,        // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-
-	q, err := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		true,  // delete when usused
-		true,  // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	// Get every routing key
-	err = ch.QueueBind(
-		q.Name,     // queue name
-		"#",        // routing key
-		"workflow", // exchange
-		false,      // no wait
-		nil,        // args
-	)
-	failOnError(err, "Failed to bind a queue")
-
-	msgs, err := ch.Consume(
-		q.Name,       // queue
-		h.workerName, // consumer
-		true,         // auto ack
-		true,         // exclusive
-		false,        // no local
-		false,        // no wait
-		nil,          // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	log.Println("Ready wait for 'workflow' command events")
+// handleIncomingCommand execute a workflow command <worker>.<aid>.<wid>.<command>
+func (h *handler) handleIncomingCommand(d Delivery) {
+	rk := strings.Split(d.RoutingKey, ".")
+	if len(rk) < 4 {
+		log.Println("missing command", d.RoutingKey)
+		return
+	}
+	worker := rk[0]
+	aid := rk[1]
+	wid := rk[2]
+	cmd := rk[3]
+	switch cmd {
+	case "start", "resume":
+		if !h.owns(worker, wid) {
+			if has := h.stopWorkflow(wid); has {
+				log.Printf("STOP workflow %s.%s moved to %s", aid, wid, worker)
+			}
+			return
+		}
 
-	for d := range msgs {
-		rk := strings.Split(d.RoutingKey, ".")
-		if len(rk) < 4 {
-			log.Println("missing command", d.RoutingKey)
-			d.Ack(false)
-			continue
+		var w dbWorkflow
+		err := json.Unmarshal(d.Body, &w)
+		if err != nil {
+			log.Printf("from workflow topic, could not unmarshal workflow %s.%s: %v", aid, wid, err)
+			return
+		}
+		if err := h.startWorkflow(w); err != nil {
+			log.Printf("from workflow topic, could not start workflow %s.%s: %v", aid, wid, err)
+			return
 		}
-		worker := rk[0]
-		aid := rk[1]
-		wid := rk[2]
-		cmd := rk[3]
-		switch cmd {
-		case "start":
-			if worker != h.workerName {
-				if has := h.stopWorkflow(wid); has {
-					log.Printf("STOP workflow %s.%s moved to %s", aid, wid, worker)
-				}
-				continue
-			}
 
-			var w dbWorkflow
-			err := json.Unmarshal(d.Body, &w)
-			if err != nil {
-				log.Printf("from workflow topic, could not unmarshal workflow %s.%s: %v", aid, wid, err)
-				continue
-			}
-			if err := h.startWorkflow(w); err != nil {
-				log.Printf("from workflow topic, could not start workflow %s.%s: %v", aid, wid, err)
-				continue
-			}
+	case "pause":
+		if !h.owns(worker, wid) {
+			return
+		}
+		var w dbWorkflow
+		err := json.Unmarshal(d.Body, &w)
+		if err != nil {
+			log.Printf("from workflow topic, could not unmarshal workflow %s.%s: %v", aid, wid, err)
+			return
+		}
+		h.pauseWorkflow(w)
+		log.Printf("from workflow topic PAUSE workflow %s.%s", aid, wid)
 
-		case "stop":
-			if h.stopWorkflow(wid) {
-				log.Printf("from workflow topic STOP workflow %s.%s", aid, wid)
-			}
+	case "stop":
+		if h.stopWorkflow(wid) {
+			log.Printf("from workflow topic STOP workflow %s.%s", aid, wid)
 		}
 	}
 }
 
 func (h *handler) sendStarCommand(w dbWorkflow) error {
+	return h.sendCommand(w, "start")
+}
+
+// sendCommand send the command start, pause or resume with the workflow to its worker
+func (h *handler) sendCommand(w dbWorkflow, cmd string) error {
 	body, err := json.Marshal(w)
 	if err != nil {
 		return err
 	}
-	return h.sendCmdCh.Publish(
-		"workflow", // exchange
-		fmt.Sprintf("%s.%s.%s.start", w.Worker, w.AccountID, w.ID), // routing key
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			Headers:      amqp.Table{"timestamp": time.Now().Format(time.RFC3339Nano)},
-			ContentType:  "application/json",
-			Body:         body,
+	return h.transport.PublishCommand(
+		fmt.Sprintf("%s.%s.%s.%s", w.Worker, w.AccountID, w.ID, cmd),
+		Message{
+			Headers:     map[string]interface{}{"timestamp": time.Now().Format(time.RFC3339Nano)},
+			ContentType: "application/json",
+			Body:        body,
 		})
 }
 
 func (h *handler) sendStopCommand(acoundID, workflowID string) error {
-	return h.sendCmdCh.Publish(
-		"workflow", // exchange
-		fmt.Sprintf(".%s.%s.stop", acoundID, workflowID), // routing key
-		false, // mandatory
-		false, // immediate
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			Headers:      amqp.Table{"timestamp": time.Now().Format(time.RFC3339Nano)},
+	return h.transport.PublishCommand(
+		fmt.Sprintf(".%s.%s.stop", acoundID, workflowID),
+		Message{
+			Headers: map[string]interface{}{"timestamp": time.Now().Format(time.RFC3339Nano)},
 		})
 }
 
-func (h *handler) handleAccountDeleted() {
-	ch, err := h.conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	err = ch.ExchangeDeclare(
-		"account", // name
-		"fanout",  // type
-		true,      // durable
-		false,     // auto-deleted
-		false,     // internal
-		false,     // no-wait
-		nil,       // arguments
-	)
-	failOnError(err, "Failed to declare a account exchange")
-
-	q, err := ch.QueueDeclare(
-		"workflow-engine_account", // name
-		true,                      // durable
-		false,                     // delete when usused
-		false,                     // exclusive
-		false,                     // no-wait
-		nil,                       // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	err = ch.QueueBind(
-		q.Name,     // queue name
-		"#.delete", // routing key
-		"account",  // exchange
-		false,      // no-wait
-		nil)
+// handleAccountDeleted stop and purge the workflows of the deleted account <aid>.delete
+func (h *handler) handleAccountDeleted(d Delivery) {
+	straid := strings.SplitN(d.RoutingKey, ".", 2)
+	aid, err := uuid.FromString(straid[0])
 	if err != nil {
-		log.Panicln(err)
+		log.Printf("cannot extract aid from routing key %v: %v\n", d.RoutingKey, err)
+		d.Ack()
+		return
 	}
+	log.Printf("purge sensors for account %v\n", aid)
 
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	log.Println("Ready, wait on topic 'account'")
-
-	for d := range msgs {
-		straid := strings.SplitN(d.RoutingKey, ".", 2)
-		aid, err := uuid.FromString(straid[0])
-		if err != nil {
-			log.Printf("cannot extract aid from routing key %v: %v\n", d.RoutingKey, err)
-			d.Ack(false)
+	query := "SELECT DISTINCT id FROM workflow WHERE account_id = $1"
+	rows, err := h.db.Query(query, aid)
+	if err != nil {
+		log.Printf("cannot find the workflows of %v: %v\n", aid, err)
+		d.Reject(true)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var wid string
+		lerr := rows.Scan(&wid)
+		if lerr != nil {
+			err = lerr
+			log.Printf("could not scan workflow from db: %v", err)
 			continue
 		}
-		log.Printf("purge sensors for account %v\n", aid)
-
-		query := "SELECT DISTINCT id FROM workflow WHERE account_id = $1"
-		rows, err := h.db.Query(query, aid)
-		if err != nil && err != sql.ErrNoRows {
-			d.Nack(false, true)
-			failOnError(err, "could not retreive workflow to lunch")
-		}
-		for rows.Next() {
-			var wid string
-			lerr := rows.Scan(&wid)
-			if lerr != nil {
-				err = lerr
-				log.Printf("could not scan workflow from db: %v", err)
-				continue
-			}
-			h.sendStopCommand(aid.String(), wid)
-		}
-
-		_, err = h.db.Exec("DELETE FROM workflow WHERE account_id=$1;", aid)
-		if err != nil {
-			log.Printf("cannot purge %v: %v\n", aid, err)
-		}
-		d.Ack(false)
-	}
-}
-
-func findLatestSensors(ctx context.Context, conn *amqp.Connection, aid uuid.UUID, corrID string) (<-chan map[string]interface{}, error) {
-	ch, err := conn.Channel()
-	if err != nil {
-		return nil, err
+		h.sendStopCommand(aid.String(), wid)
 	}
 
-	q, err := ch.QueueDeclare(
-		"",    // name
-		false, // durable
-		true,  // delete when usused
-		true,  // exclusive
-		false, // noWait
-		nil,   // arguments
-	)
+	_, err = h.db.Exec("DELETE FROM workflow WHERE account_id=$1;", aid)
 	if err != nil {
-		return nil, err
+		log.Printf("cannot purge %v: %v\n", aid, err)
 	}
-
-	msgs, err := ch.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
+	_, err = h.db.Exec("DELETE FROM workflow_state WHERE account_id=$1;", aid)
 	if err != nil {
-		return nil, err
+		log.Printf("cannot purge state of %v: %v\n", aid, err)
 	}
-
-	request := struct {
-		AID uuid.UUID `json:"aid"`
-	}{aid}
-
-	body, err := json.Marshal(request)
+	_, err = h.db.Exec("DELETE FROM workflow_output WHERE account_id=$1;", aid)
 	if err != nil {
-		return nil, err
+		log.Printf("cannot purge output history of %v: %v\n", aid, err)
 	}
-
-	err = ch.Publish(
-		"",                   // exchange
-		"rpc_sensors_latest", // routing key
-		false,                // mandatory
-		false,                // immediate
-		amqp.Publishing{
-			ContentType:   "text/plain",
-			CorrelationId: corrID,
-			ReplyTo:       q.Name,
-			Body:          body,
-		},
-	)
+	_, err = h.db.Exec("DELETE FROM workflow_webhook_delivery WHERE account_id=$1;", aid)
 	if err != nil {
-		return nil, err
+		log.Printf("cannot purge webhook deliveries of %v: %v\n", aid, err)
 	}
-
-	latests := make(chan map[string]interface{}, 16)
-
-	go func() {
-		defer func() {
-			ch.QueueDelete(q.Name, false, false, false)
-			ch.Close()
-		}()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case d := <-msgs:
-				if corrID == d.CorrelationId {
-					var s []map[string]interface{}
-					err := json.Unmarshal(d.Body, &s)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					d.Ack(false)
-					for _, ms := range s {
-						latests <- ms
-					}
-					return
-				}
-			}
-		}
-	}()
-
-	return latests, nil
+	d.Ack()
 }
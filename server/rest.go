@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"net/http"
+	"strconv"
 	"time"
 	"encoding/json"
 	"github.com/gofrs/uuid"
@@ -16,6 +18,9 @@ type swaggerWorkflow struct {
 	//swagger:strfmt uuid
 	//example: 671dd0e5-895c-425e-9303-8c14cc3fc46c
 	ID string `json:"id"`
+	// Version number, incremented on each new version
+	// example: 3
+	Revision int `json:"revision"`
 	//swagger:strfmt uuid
 	// example: fe22559b-ba9f-404f-9732-f89e830969f2
 	AccoundID string    `json:"accound_id"`
@@ -23,7 +28,9 @@ type swaggerWorkflow struct {
 
 	// The worker name to assign the workflow
 	// example: worklow-engine0
-	Worker  string `json:"worker"`
+	Worker string `json:"worker"`
+	// False when the workflow is paused
+	Enabled bool   `json:"enabled"`
 	Name    string `json:"name"`
 	Version string `json:"version"`
 	Graph   map[string]struct {
@@ -82,23 +89,23 @@ func (h *handler) getWorkflows(c echo.Context) error {
 
 	// SQL query
 	wf := make([]dbWorkflow, 0, 16)
-	query := `SELECT account_id, id, created_at, name, worker, version
+	query := `SELECT ` + workflowColumns + `
 	FROM workflow JOIN (
-		SELECT id as maxid, MAX(created_at) as maxc
+		SELECT id as maxid, MAX(revision) as maxr
 		FROM workflow
-		WHERE account_id = $1
+		WHERE account_id = $1 AND deleted_at IS NULL
 		GROUP BY maxid
 	) w
-	ON w.maxc = created_at AND w.maxid = id AND account_id = $1
+	ON w.maxr = revision AND w.maxid = id AND account_id = $1
 	;`
 	rows, err := h.db.Query(query, account.ID)
 	if err != nil {
 		c.Logger().Errorf("cannot find workflow for %v: %v", account.ID, err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer rows.Close()
 	for rows.Next() {
-		var w dbWorkflow
-		lerr := rows.Scan(&w.AccountID, &w.ID, &w.CreatedAt, &w.Name, &w.Worker, &w.Version, &w.Graph)
+		w, lerr := scanWorkflow(rows)
 		if lerr != nil {
 			err = lerr
 			continue
@@ -112,7 +119,7 @@ func (h *handler) getWorkflows(c echo.Context) error {
 	return c.JSON(http.StatusOK, wf)
 }
 
-//swagger:parameters id workflow workflowHistory workflowOuputID delworkflowID
+//swagger:parameters id workflow workflowHistory workflowOuputID delworkflowID testworkflow putworkflow patchworkflow pauseworkflow resumeworkflow restoreworkflow
 type idParam struct {
 	//in:path
 	//required:true
@@ -124,7 +131,8 @@ type idParam struct {
 //
 // Workflow
 //
-// Get a workflow by its id
+// Get a workflow by its id.
+// The ETag header is the revision to send in If-Match to update the workflow.
 //
 //     Produces:
 //     - application/json
@@ -134,34 +142,45 @@ type idParam struct {
 //     Responses:
 //       200: workflowResponse
 //       400:
+//       404:
 //       500:
 func (h *handler) getWorkflowID(c echo.Context) error {
 	// Auth
 	account := c.Get("account").(auth.Account)
 	wid := c.Param("wid")
 
-	query := `SELECT account_id, id, created_at, name, worker, version, graph
-		FROM workflow
-		WHERE created_at = (
-			SELECT MAX(created_at) FROM workflow
-			WHERE account_id = $1 AND id = $2
-		)
-		AND account_id = $1 AND id = $2
-	;`
-	row := h.db.QueryRow(query, account.ID, wid)
-	if row == nil {
-		c.Logger().Errorf("cannot get workflow %v %v", account.ID, wid)
-		return c.NoContent(http.StatusInternalServerError)
+	w, err := h.findWorkflow(account.ID, wid)
+	if err == sql.ErrNoRows {
+		return c.NoContent(http.StatusNotFound)
 	}
-	var w dbWorkflow
-	err := row.Scan(&w.AccountID, &w.ID, &w.CreatedAt, &w.Name, &w.Worker, &w.Version, &w.Graph)
 	if err != nil {
 		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	setETag(c, w)
 	return c.JSON(http.StatusOK, w)
 }
 
+// findWorkflow return the latest version of the workflow
+func (h *handler) findWorkflow(aid uuid.UUID, wid string) (dbWorkflow, error) {
+	query := `SELECT ` + workflowColumns + `
+		FROM workflow
+		WHERE account_id = $1 AND id = $2 AND deleted_at IS NULL
+		ORDER BY revision DESC
+		LIMIT 1
+	;`
+	return scanWorkflow(h.db.QueryRow(query, aid, wid))
+}
+
+// findWorkflowRevision return the given version of the workflow
+func (h *handler) findWorkflowRevision(aid uuid.UUID, wid string, revision int) (dbWorkflow, error) {
+	query := `SELECT ` + workflowColumns + `
+		FROM workflow
+		WHERE account_id = $1 AND id = $2 AND revision = $3 AND deleted_at IS NULL
+	;`
+	return scanWorkflow(h.db.QueryRow(query, aid, wid, revision))
+}
+
 // swagger:route GET /workflow/history/{id} Workflow workflowHistory
 //
 // Workflow History
@@ -182,20 +201,20 @@ func (h *handler) getWorkflowIDHistory(c echo.Context) error {
 	account := c.Get("account").(auth.Account)
 	wid := c.Param("wid")
 
-	query := `SELECT account_id, id, created_at, name, worker, version, graph
+	query := `SELECT ` + workflowColumns + `
 		FROM workflow
-		AND account_id = $1 AND id = $2
-		ORDER BY created_at
+		WHERE account_id = $1 AND id = $2 AND deleted_at IS NULL
+		ORDER BY revision
 	;`
 	rows, err := h.db.Query(query, account.ID, wid)
 	if err != nil {
 		c.Logger().Errorf("cannot find workflow for %v %v: %v", account.ID, wid, err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer rows.Close()
 	wf := make([]dbWorkflow, 0, 16)
 	for rows.Next() {
-		var w dbWorkflow
-		lerr := rows.Scan(&w.AccountID, &w.ID, &w.CreatedAt, &w.Name, &w.Worker, &w.Version)
+		w, lerr := scanWorkflow(rows)
 		if lerr != nil {
 			err = lerr
 			continue
@@ -246,12 +265,12 @@ func (h *handler) getWorkflowOutput(c echo.Context) error {
 	// SQL query
 	query := `SELECT id, graph
 	FROM workflow JOIN (
-		SELECT id as maxid, MAX(created_at) as maxc
+		SELECT id as maxid, MAX(revision) as maxr
 		FROM workflow
-		WHERE account_id = $1
+		WHERE account_id = $1 AND deleted_at IS NULL
 		GROUP BY maxid
 	) w
-	ON w.maxc = created_at AND w.maxid = id AND account_id = $1
+	ON w.maxr = revision AND w.maxid = id AND account_id = $1
 	;`
 	rows, err := h.db.Query(query, account.ID)
 	if err != nil {
@@ -313,11 +332,9 @@ func (h *handler) getWorkflowOutputID(c echo.Context) error {
 
 	query := `SELECT graph
 		FROM workflow
-		WHERE created_at = (
-			SELECT MAX(created_at) FROM workflow
-			WHERE account_id = $1 AND id = $2
-		)
-		AND account_id = $1 AND id = $2
+		WHERE account_id = $1 AND id = $2 AND deleted_at IS NULL
+		ORDER BY revision DESC
+		LIMIT 1
 	;`
 	row := h.db.QueryRow(query, account.ID, wid)
 	if row == nil {
@@ -346,7 +363,7 @@ func (h *handler) getWorkflowOutputID(c echo.Context) error {
 	return c.JSON(http.StatusOK, outs)
 }
 
-//swagger:parameters swaggerWorkflowPost posrworkflow
+//swagger:parameters swaggerWorkflowPost posrworkflow putworkflow
 type swaggerWorkflowPost struct {
 	//in:body
 	//required:true
@@ -358,6 +375,9 @@ type swaggerWorkflowPost struct {
 // Workflow
 //
 // Create a new Workflow.
+// Without worker, a new workflow is assigned to the alive worker with the fewest workflows.
+// The id of an existing workflow is rejected with 409 and the latest version,
+// unless the If-Match header is the ETag (revision) of the latest version.
 //
 // Consumes:
 // - application/json
@@ -367,6 +387,7 @@ type swaggerWorkflowPost struct {
 // Responses:
 //   200: workflowResponse
 //   400:
+//   409:
 //   500:
 func (h *handler) postWorkflow(c echo.Context) error {
 	// Auth
@@ -380,20 +401,34 @@ func (h *handler) postWorkflow(c echo.Context) error {
 
 	w.CreatedAt = time.Now()
 	w.AccountID = account.ID
+	// the workflow must not exist yet, or be the version given in If-Match
+	base := 0
 	if w.ID == uuid.Nil {
 		w.ID = uuid.Must(uuid.NewV4())
+	} else if c.Request().Header.Get("If-Match") != "" {
+		var err error
+		base, err = ifMatch(c)
+		if base == 0 {
+			return err
+		}
 	}
 	if w.Worker == "" {
-		w.Worker = h.workerName
+		// keep a new version on the worker of the workflow, place a new workflow on the least loaded worker
+		if latest, err := h.findWorkflow(account.ID, w.ID.String()); err == nil {
+			w.Worker = latest.Worker
+		} else {
+			w.Worker = h.placeWorkflow()
+		}
 	}
 
+	return h.saveWorkflow(c, w, base)
+}
+
+// saveWorkflow check the graph and run the tests of the workflow, then insert it as a new version
+// on top of the base version (see insertWorkflow) and start it.
+func (h *handler) saveWorkflow(c echo.Context, w dbWorkflow, base int) error {
 	// Check the validity of the graph
-	graph := workflow.FlowGraph{
-		ID:   w.ID,
-		AID:  w.AccountID,
-		Name: w.Name,
-	}
-	err := json.Unmarshal(w.Graph, &graph.Flow)
+	graph, err := newFlowGraph(w)
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
 	}
@@ -401,16 +436,302 @@ func (h *handler) postWorkflow(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
 	}
 
+	// Only accept the version if every test passed
+	if len(w.Tests) == 0 {
+		w.Tests = json.RawMessage("[]")
+	}
+	results, err := runWorkflowTests(w, graph)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	if !workflow.TestsPassed(results) {
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"message": "workflow tests failed", "tests": results})
+	}
+
 	// Insert into DB
-	_, err = h.db.Exec("INSERT INTO workflow (account_id, id, created_at, worker, name, version, graph) VALUES ($1,$2,$3,$4,$5,$6,$7);",
-		w.AccountID,
-		w.ID,
-		w.CreatedAt,
-		w.Worker,
-		w.Name,
-		w.Version,
-		w.Graph,
-	)
+	err = insertWorkflow(h.db, &w, base)
+	if err == errConflict {
+		return h.conflict(c, w)
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot insert workflow for %v: %v", w.AccountID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	h.sendStarCommand(w)
+
+	setETag(c, w)
+	return c.JSON(http.StatusOK, w)
+}
+
+type simulateRequest struct {
+	// The graph to simulate
+	Graph json.RawMessage `json:"graph"`
+	// Sensor messages in the order to feed the graph
+	Messages []workflow.SimulationMessage `json:"messages"`
+}
+
+//swagger:parameters simulateworkflow
+type swaggerSimulatePost struct {
+	//in:body
+	//required:true
+	Body simulateRequest
+}
+
+// Successfull
+// swagger:response simulateResponse
+type simulateResponse struct {
+	// in: body
+	Body []workflow.SimulationStep
+}
+
+// swagger:route POST /workflow/simulate Workflow simulateworkflow
+//
+// Simulate
+//
+// Dry-run a graph against the given sensor messages.
+// Nothing is published, every step report the accepted inputs, the node values, the outputs and the webhooks.
+//
+// Consumes:
+// - application/json
+// Produces:
+// - application/json
+// Schemes: http, https
+// Responses:
+//   200: simulateResponse
+//   400:
+func (h *handler) postWorkflowSimulate(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+
+	var req simulateRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+
+	graph, err := newFlowGraph(dbWorkflow{AccountID: account.ID, Graph: req.Graph})
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	steps, err := workflow.Simulate(graph, req.Messages)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	return c.JSON(http.StatusOK, steps)
+}
+
+// Successfull
+// swagger:response testResponse
+type testResponse struct {
+	// in: body
+	Body []workflow.TestResult
+}
+
+// swagger:route POST /workflow/{id}/test Workflow testworkflow
+//
+// Test
+//
+// Run the tests stored with the latest version of the workflow
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: testResponse
+//       404:
+//       500:
+func (h *handler) postWorkflowTest(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+
+	w, err := h.findWorkflow(account.ID, wid)
+	if err == sql.ErrNoRows {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	graph, err := newFlowGraph(w)
+	if err != nil {
+		c.Logger().Errorf("cannot parse workflow %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	results, err := runWorkflowTests(w, graph)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	return c.JSON(http.StatusOK, results)
+}
+
+//swagger:parameters workflowVersion workflowRollback
+type swaggerRevisionParam struct {
+	//in:path
+	//required:true
+	//example:671dd0e5-895c-425e-9303-8c14cc3fc46c
+	ID string `json:"id"`
+	//in:path
+	//required:true
+	//example:2
+	N int `json:"n"`
+}
+
+// parseRevision return the version number in the path parameter
+func parseRevision(c echo.Context, name string) (int, error) {
+	n, err := strconv.Atoi(c.Param(name))
+	if err != nil || n < 1 {
+		return 0, c.JSON(http.StatusBadRequest, map[string]string{"message": "invalid version number " + c.Param(name)})
+	}
+	return n, nil
+}
+
+// swagger:route GET /workflow/{id}/versions/{n} Workflow workflowVersion
+//
+// Workflow Version
+//
+// Get the version n of a workflow
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowResponse
+//       400:
+//       404:
+//       500:
+func (h *handler) getWorkflowVersion(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+	n, err := parseRevision(c, "n")
+	if n == 0 {
+		return err
+	}
+
+	w, err := h.findWorkflowRevision(account.ID, wid, n)
+	if err == sql.ErrNoRows {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setETag(c, w)
+	return c.JSON(http.StatusOK, w)
+}
+
+// Successfull
+// swagger:response diffResponse
+type diffResponse struct {
+	// in: body
+	Body workflow.GraphDiff
+}
+
+// swagger:route GET /workflow/{id}/versions/{n}/diff/{m} Workflow workflowDiff
+//
+// Workflow Diff
+//
+// Get the nodes added, removed and changed from the version n to the version m of a workflow
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: diffResponse
+//       400:
+//       404:
+//       500:
+func (h *handler) getWorkflowDiff(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+
+	var graphs [2]*workflow.FlowGraph
+	for i, param := range []string{"n", "m"} {
+		n, err := parseRevision(c, param)
+		if n == 0 {
+			return err
+		}
+		w, err := h.findWorkflowRevision(account.ID, wid, n)
+		if err == sql.ErrNoRows {
+			return c.NoContent(http.StatusNotFound)
+		}
+		if err != nil {
+			c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		graphs[i], err = newFlowGraph(w)
+		if err != nil {
+			c.Logger().Errorf("cannot parse workflow %v.%v version %d: %v", account.ID, wid, n, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	return c.JSON(http.StatusOK, workflow.Diff(graphs[0].Flow, graphs[1].Flow))
+}
+
+// swagger:route POST /workflow/{id}/rollback/{n} Workflow workflowRollback
+//
+// Workflow Rollback
+//
+// Deploy again the version n of a workflow as a new version.
+// With an If-Match header, the rollback is rejected with 409 if the latest version is not this revision.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowResponse
+//       400:
+//       404:
+//       409:
+//       500:
+func (h *handler) postWorkflowRollback(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+	n, err := parseRevision(c, "n")
+	if n == 0 {
+		return err
+	}
+
+	w, err := h.findWorkflowRevision(account.ID, wid, n)
+	if err == sql.ErrNoRows {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	// keep the workflow on its current worker
+	latest, err := h.findWorkflow(account.ID, wid)
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	w.Worker = latest.Worker
+	w.CreatedAt = time.Now()
+
+	base := -1
+	if c.Request().Header.Get("If-Match") != "" {
+		if base, err = ifMatch(c); base == 0 {
+			return err
+		}
+	}
+
+	err = insertWorkflow(h.db, &w, base)
+	if err == errConflict {
+		return h.conflict(c, w)
+	}
 	if err != nil {
 		c.Logger().Errorf("cannot insert workflow for %v: %v", account.ID, err)
 		return c.NoContent(http.StatusInternalServerError)
@@ -418,6 +739,79 @@ func (h *handler) postWorkflow(c echo.Context) error {
 
 	h.sendStarCommand(w)
 
+	setETag(c, w)
+	return c.JSON(http.StatusOK, w)
+}
+
+// swagger:route POST /workflow/{id}/pause Workflow pauseworkflow
+//
+// Pause Workflow
+//
+// Disable a workflow, it is stopped by its worker and not started again until resumed.
+// Its runtime state is kept.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowResponse
+//       404:
+//       500:
+func (h *handler) postWorkflowPause(c echo.Context) error {
+	return h.setWorkflowEnabled(c, false)
+}
+
+// swagger:route POST /workflow/{id}/resume Workflow resumeworkflow
+//
+// Resume Workflow
+//
+// Enable a paused workflow, its worker start the latest version from the saved state.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowResponse
+//       404:
+//       500:
+func (h *handler) postWorkflowResume(c echo.Context) error {
+	return h.setWorkflowEnabled(c, true)
+}
+
+// setWorkflowEnabled update the enabled state of every version and send the pause or resume command
+func (h *handler) setWorkflowEnabled(c echo.Context, enabled bool) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+
+	res, err := h.db.Exec("UPDATE workflow SET enabled=$3 WHERE id=$1 AND account_id=$2 AND deleted_at IS NULL;", wid, account.ID, enabled)
+	if err != nil {
+		c.Logger().Errorf("cannot update workflow %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	w, err := h.findWorkflow(account.ID, wid)
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	cmd := "pause"
+	if enabled {
+		cmd = "resume"
+	}
+	if err := h.sendCommand(w, cmd); err != nil {
+		c.Logger().Errorf("cannot send %s command for %v.%v: %v", cmd, account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	setETag(c, w)
 	return c.JSON(http.StatusOK, w)
 }
 
@@ -425,7 +819,7 @@ func (h *handler) postWorkflow(c echo.Context) error {
 //
 // Workflow
 //
-// Delete the given workflow
+// Move the given workflow to the trash, it is stopped and can be restored until purged.
 //
 //     Produces:
 //     - application/json
@@ -435,20 +829,26 @@ func (h *handler) postWorkflow(c echo.Context) error {
 //     Responses:
 //       200:
 //       400:
+//       404:
 //       500:
 func (h *handler) deleteWorkflow(c echo.Context) error {
 	// Auth
 	account := c.Get("account").(auth.Account)
-	wid := c.Param("wid")
+	wid, err := uuid.FromString(c.Param("wid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
 
-	_, err := h.db.Exec("DELETE FROM workflow WHERE id=$1 and account_id=$2;", wid, account.ID)
+	res, err := h.db.Exec("UPDATE workflow SET deleted_at=NOW() WHERE id=$1 AND account_id=$2 AND deleted_at IS NULL;", wid, account.ID)
 	if err != nil {
+		c.Logger().Errorf("cannot delete workflow %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	h.sendStopCommand(account.ID.String(), wid)
-
-	// h.flows.Delete(wid)
+	h.sendStopCommand(account.ID.String(), wid.String())
 
 	return c.NoContent(http.StatusOK)
 }
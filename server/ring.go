@@ -0,0 +1,90 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// ringReplicas is the number of points of each member on the ring
+const ringReplicas = 100
+
+// hashRing assign keys to members by consistent hashing.
+// Adding or removing a member only move the keys of its points.
+type hashRing struct {
+	points  []uint64
+	owners  map[uint64]string
+	members []string
+}
+
+// ringHash is fnv-1a with the finalizer of murmur3, fnv alone spread badly the close strings
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// newHashRing with the given members, the duplicates are ignored
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{owners: make(map[uint64]string), members: uniqueSorted(members)}
+	for _, m := range r.members {
+		for i := 0; i < ringReplicas; i++ {
+			p := ringHash(m + "#" + strconv.Itoa(i))
+			// on collision the smallest name win, the members are sorted
+			if _, exist := r.owners[p]; exist {
+				continue
+			}
+			r.points = append(r.points, p)
+			r.owners[p] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// uniqueSorted return the sorted names without duplicates
+func uniqueSorted(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	res := make([]string, 0, len(names))
+	for _, n := range names {
+		if !seen[n] {
+			seen[n] = true
+			res = append(res, n)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// owner of the key, the member of the first point after its hash. Empty if the ring has no member.
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// sameMembers return true if the ring has exactly these members
+func (r *hashRing) sameMembers(members []string) bool {
+	other := uniqueSorted(members)
+	if len(other) != len(r.members) {
+		return false
+	}
+	for i := range other {
+		if other[i] != r.members[i] {
+			return false
+		}
+	}
+	return true
+}
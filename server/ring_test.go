@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	r := newHashRing(nil)
+	if o := r.owner("a"); o != "" {
+		t.Errorf("empty ring should not have owner, got %s", o)
+	}
+
+	r = newHashRing([]string{"w0", "w1", "w2", "w1"})
+	if len(r.members) != 3 || !r.sameMembers([]string{"w2", "w0", "w1"}) {
+		t.Errorf("wrong members %v", r.members)
+	}
+	keys := make([]string, 3000)
+	count := make(map[string]int)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("workflow-%d", i)
+		count[r.owner(keys[i])]++
+	}
+	for _, m := range r.members {
+		// each member should have roughly a third of the keys
+		if count[m] < 600 || count[m] > 1400 {
+			t.Errorf("unbalanced ring %v", count)
+		}
+	}
+
+	// adding a member only move keys to the new member
+	r4 := newHashRing([]string{"w0", "w1", "w2", "w3"})
+	moved := 0
+	for _, k := range keys {
+		before, after := r.owner(k), r4.owner(k)
+		if before == after {
+			continue
+		}
+		moved++
+		if after != "w3" {
+			t.Fatalf("key %s moved from %s to %s", k, before, after)
+		}
+	}
+	if moved == 0 || moved > len(keys)/2 {
+		t.Errorf("%d keys moved on %d", moved, len(keys))
+	}
+}
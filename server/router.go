@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sensorRouter consume the sensor messages of every workflow of the worker with a single consumer.
+// The consumer is bound to the union of the input sensors of the workflows and each message is
+// dispatched in process to the workflows using its sensor.
+// A message is acknowledged once processed by all these workflows, those rejected by a workflow
+// are published as dead letters.
+// The routing keys can also be watched to observe their messages, like the outputs of the streamed workflows.
+type sensorRouter struct {
+	transport  Transport
+	workerName string
+	observe    func(Message) // receive the messages of the watched routing keys, set before the first watch
+
+	mu      sync.RWMutex
+	routes  map[string]map[*Workflow]struct{} // the workflows by routing key <aid>.<sensorID>
+	watches map[string]int                    // the number of watchers by routing key
+}
+
+// newSensorRouter start to consume the sensor messages in background
+func newSensorRouter(t Transport, workerName string) *sensorRouter {
+	r := &sensorRouter{
+		transport:  t,
+		workerName: workerName,
+		routes:     make(map[string]map[*Workflow]struct{}),
+		watches:    make(map[string]int),
+	}
+	go t.ConsumeSensors(r.dispatch)
+	return r
+}
+
+// routingKeys of the input sensors of the workflow
+func routingKeys(wo *Workflow) []string {
+	keys := make([]string, 0, len(wo.graph.Inputs))
+	for sensorID := range wo.graph.Inputs {
+		keys = append(keys, fmt.Sprintf("%s.%s", wo.graph.AID, sensorID))
+	}
+	return keys
+}
+
+// add the workflow to the receivers of its input sensors, the new routing keys are bound
+func (r *sensorRouter) add(wo *Workflow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range routingKeys(wo) {
+		subs, exist := r.routes[key]
+		if !exist {
+			subs = make(map[*Workflow]struct{})
+			r.routes[key] = subs
+			if r.watches[key] == 0 {
+				r.transport.BindSensor(key)
+			}
+		}
+		subs[wo] = struct{}{}
+	}
+}
+
+// remove the workflow from the receivers, the routing keys no longer used are unbound
+func (r *sensorRouter) remove(wo *Workflow) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range routingKeys(wo) {
+		subs := r.routes[key]
+		delete(subs, wo)
+		if len(subs) > 0 {
+			continue
+		}
+		delete(r.routes, key)
+		if r.watches[key] == 0 {
+			r.transport.UnbindSensor(key)
+		}
+	}
+}
+
+// watch the messages of the routing keys, they are passed to observe before their dispatch
+func (r *sensorRouter) watch(keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		r.watches[key]++
+		if r.watches[key] == 1 && len(r.routes[key]) == 0 {
+			r.transport.BindSensor(key)
+		}
+	}
+}
+
+// unwatch the routing keys, those no longer used are unbound
+func (r *sensorRouter) unwatch(keys []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		r.watches[key]--
+		if r.watches[key] > 0 {
+			continue
+		}
+		delete(r.watches, key)
+		if len(r.routes[key]) == 0 {
+			r.transport.UnbindSensor(key)
+		}
+	}
+}
+
+// dispatch the message to the workflows using its sensor, in the order of arrival for each workflow.
+// The message is queued in the mailbox of each workflow without waiting, a slow workflow does not
+// delay the others. The lock is released before queuing, the mailbox of a stopped workflow is closed.
+func (r *sensorRouter) dispatch(d Delivery) {
+	r.mu.RLock()
+	watched := r.watches[d.RoutingKey] > 0
+	subs := make([]*Workflow, 0, len(r.routes[d.RoutingKey]))
+	for wo := range r.routes[d.RoutingKey] {
+		subs = append(subs, wo)
+	}
+	r.mu.RUnlock()
+
+	if watched {
+		m := d.Message
+		if decoded, isEvent, err := decodeCloudEvent(m); err == nil && isEvent {
+			m = decoded
+		}
+		r.observe(m)
+	}
+	if len(subs) == 0 {
+		// the routing key was unbound after the message was delivered
+		if err := d.Ack(); err != nil {
+			log.Printf("cannot ack %s: %v", d.RoutingKey, err)
+		}
+		return
+	}
+	sd := &sensorDelivery{Delivery: d, original: d.Message, router: r, pending: int32(len(subs))}
+	// the span of the message lasts until it is settled, the trace is continued from the publisher
+	ctx := propagator.Extract(context.Background(), headerCarrier(d.Headers))
+	_, sd.span = tracing.Start(ctx, "sensor.receive", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+		attribute.String("messaging.destination", "sensors"),
+		attribute.String("messaging.routing_key", d.RoutingKey),
+		attribute.String("workflow.worker", r.workerName),
+		attribute.Int("workflow.count", len(subs)),
+	))
+	// the sensor messages may be CloudEvents, the workflows receive their data
+	if m, isEvent, err := decodeCloudEvent(d.Message); err != nil {
+		log.Printf("cannot decode the CloudEvents %s: %v", d.RoutingKey, err)
+	} else if isEvent {
+		sd.Message = m
+	}
+	for _, wo := range subs {
+		if !wo.inbox.push(sd) {
+			sd.done(wo.graph.ID.String(), nil)
+		}
+	}
+}
+
+// mailbox queue the sensor messages of a workflow without bound.
+// The messages are not acknowledged until processed, the prefetch of the consumer bound their number.
+type mailbox struct {
+	mu     sync.Mutex
+	queue  []*sensorDelivery
+	closed bool
+	ready  chan struct{} // signaled when messages are queued
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{ready: make(chan struct{}, 1)}
+}
+
+// push the message at the end of the queue, it returns false if the mailbox is closed
+func (m *mailbox) push(d *sensorDelivery) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return false
+	}
+	m.queue = append(m.queue, d)
+	m.signal()
+	return true
+}
+
+// pop the first message, nil if the queue is empty
+func (m *mailbox) pop() *sensorDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.queue) == 0 {
+		return nil
+	}
+	d := m.queue[0]
+	m.queue[0] = nil
+	m.queue = m.queue[1:]
+	if len(m.queue) > 0 {
+		m.signal()
+	}
+	return d
+}
+
+// len return the number of queued messages
+func (m *mailbox) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue)
+}
+
+// close the mailbox and return the messages left
+func (m *mailbox) close() []*sensorDelivery {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	left := m.queue
+	m.queue = nil
+	return left
+}
+
+// signal that messages are queued, m.mu must be held
+func (m *mailbox) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliveryFailure is the error of a workflow on a sensor message
+type deliveryFailure struct {
+	WID string
+	Err string
+}
+
+// sensorDelivery is a sensor message dispatched to several workflows
+type sensorDelivery struct {
+	Delivery
+	original Message // the message received, before the decoding of the CloudEvents
+	router   *sensorRouter
+	pending  int32 // number of workflows which did not process it yet and of unconfirmed outputs
+	span     trace.Span
+
+	mu       sync.Mutex
+	failures []deliveryFailure
+}
+
+// done is called by each workflow once the message is processed, err is set if the workflow rejected it.
+// The last call settle the message.
+func (d *sensorDelivery) done(wid string, err error) {
+	if err != nil {
+		d.mu.Lock()
+		d.failures = append(d.failures, deliveryFailure{WID: wid, Err: err.Error()})
+		d.mu.Unlock()
+	}
+	d.decrement()
+}
+
+// hold the message until an output message computed from it is confirmed, release must be called once confirmed
+func (d *sensorDelivery) hold() {
+	atomic.AddInt32(&d.pending, 1)
+}
+
+// release the message held by an output message, once confirmed or dropped by the publisher.
+// A dropped output is not computed again from a message delivered again, the message is not requeued.
+func (d *sensorDelivery) release() {
+	d.decrement()
+}
+
+// decrement the pending workflows and outputs, the last one settle the message
+func (d *sensorDelivery) decrement() {
+	if atomic.AddInt32(&d.pending, -1) == 0 {
+		d.router.settle(d)
+	}
+}
+
+// settle acknowledge the message processed by all its workflows once their outputs are confirmed or dropped.
+// It is published first on the dead letter exchange if a workflow rejected it.
+func (r *sensorRouter) settle(d *sensorDelivery) {
+	defer d.span.End()
+	if len(d.failures) > 0 {
+		d.span.SetAttributes(attribute.Bool("messaging.dead_lettered", true))
+		failSpan(d.span, fmt.Errorf("rejected by %d workflows: %s", len(d.failures), d.failures[0].Err))
+		if err := r.deadLetter(d); err != nil {
+			log.Printf("cannot dead letter %s: %v", d.RoutingKey, err)
+			// let the transport dead letter it, without the headers describing the failures
+			if err := d.Reject(false); err != nil {
+				log.Printf("cannot reject %s: %v", d.RoutingKey, err)
+			}
+			return
+		}
+		deadLetters.Inc()
+	}
+	if err := d.Ack(); err != nil {
+		log.Printf("cannot ack %s: %v", d.RoutingKey, err)
+	}
+}
+
+// deadLetter publish a copy of the message with its original routing key.
+// The headers describe the first failure and list all of them.
+func (r *sensorRouter) deadLetter(d *sensorDelivery) error {
+	headers := make(map[string]interface{}, len(d.original.Headers)+7)
+	for k, v := range d.original.Headers {
+		headers[k] = v
+	}
+	failures := make([]interface{}, len(d.failures))
+	for i, f := range d.failures {
+		failures[i] = map[string]interface{}{"workflow_id": f.WID, "error": f.Err}
+	}
+	headers["x-worker"] = r.workerName
+	headers["x-original-exchange"] = "sensors"
+	headers["x-original-routing-key"] = d.RoutingKey
+	headers["x-workflow-id"] = d.failures[0].WID
+	headers["x-error"] = d.failures[0].Err
+	headers["x-failures"] = failures
+	headers["x-failed-at"] = time.Now().Format(time.RFC3339Nano)
+
+	m := d.original
+	m.Headers = headers
+	return r.transport.PublishDeadLetter(m)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	workflow "github.com/fredericalix/yic_workflow-engine"
+	"github.com/gofrs/uuid"
+)
+
+// countAcker count the acks and the rejects of the deliveries
+type countAcker struct {
+	acks, rejects int
+}
+
+func (a *countAcker) Ack() error                { a.acks++; return nil }
+func (a *countAcker) Reject(requeue bool) error { a.rejects++; return nil }
+
+// failingTransport cannot publish the dead letters
+type failingTransport struct {
+	*memoryTransport
+}
+
+func (t failingTransport) PublishDeadLetter(m Message) error { return errors.New("closed") }
+
+func TestSensorRouter(t *testing.T) {
+	aid := uuid.Must(uuid.NewV4())
+	newWO := func(sensors ...string) *Workflow {
+		g := &workflow.FlowGraph{AID: aid, Inputs: make(map[string]map[string]*workflow.FlowNode)}
+		for _, s := range sensors {
+			g.Inputs[s] = nil
+		}
+		return &Workflow{graph: g, inbox: newMailbox(), closed: make(chan struct{})}
+	}
+	// not connected, only the index is updated
+	mt := newMemoryTransport()
+	r := &sensorRouter{transport: mt, workerName: "w0", routes: make(map[string]map[*Workflow]struct{})}
+	ack := &countAcker{}
+	a, b := newWO("s1", "s2"), newWO("s1")
+	r.add(a)
+	r.add(b)
+	if len(r.routes) != 2 {
+		t.Fatalf("expected 2 routing keys, got %v", r.routes)
+	}
+
+	r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s1"}})
+	r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s2"}})
+	r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s3"}})
+	if a.inbox.len() != 2 || b.inbox.len() != 1 {
+		t.Errorf("wrong dispatch a=%d b=%d", a.inbox.len(), b.inbox.len())
+	}
+	// the message without workflow is acknowledged at once
+	if ack.acks != 1 {
+		t.Errorf("expected 1 ack, got %d", ack.acks)
+	}
+
+	// the message is acknowledged once processed by both workflows
+	d1, d2 := a.inbox.pop(), a.inbox.pop()
+	d1.done("a", nil)
+	d2.done("a", nil)
+	if ack.acks != 2 {
+		t.Errorf("expected 2 acks, got %d", ack.acks)
+	}
+	b.inbox.pop().done("b", errors.New("bad value"))
+	dead := mt.DeadLetters()
+	if ack.acks != 3 || len(dead) != 1 {
+		t.Fatalf("expected 3 acks and 1 dead letter, got %d and %d", ack.acks, len(dead))
+	}
+	if dead[0].RoutingKey != aid.String()+".s1" {
+		t.Errorf("wrong dead letter routing %s", dead[0].RoutingKey)
+	}
+	h := dead[0].Headers
+	if h["x-workflow-id"] != "b" || h["x-error"] != "bad value" || h["x-worker"] != "w0" || len(h["x-failures"].([]interface{})) != 1 {
+		t.Errorf("wrong dead letter headers %v", h)
+	}
+
+	// the transport dead letter the message if it cannot be published
+	r.transport = failingTransport{mt}
+	r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s2"}})
+	a.inbox.pop().done("a", errors.New("bad value"))
+	if ack.acks != 3 || ack.rejects != 1 {
+		t.Errorf("expected 3 acks and 1 reject, got %d and %d", ack.acks, ack.rejects)
+	}
+
+	// a slow workflow does not block the dispatch to the others
+	for i := 0; i < 1000; i++ {
+		r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s2"}})
+	}
+	if a.inbox.len() != 1000 {
+		t.Errorf("expected 1000 queued messages, got %d", a.inbox.len())
+	}
+	for _, d := range a.inbox.close() {
+		d.done("a", nil)
+	}
+	a.inbox = newMailbox()
+	acks := ack.acks
+
+	// a stopped workflow release the message at once
+	b.inbox.close()
+	for i := 0; i < 4; i++ {
+		r.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: aid.String() + ".s1"}})
+	}
+	for i := 0; i < 4; i++ {
+		a.inbox.pop().done("a", nil)
+	}
+	if ack.acks != acks+4 {
+		t.Errorf("expected %d acks, got %d", acks+4, ack.acks)
+	}
+
+	r.remove(b)
+	r.remove(a)
+	if len(r.routes) != 0 {
+		t.Errorf("routing keys left %v", r.routes)
+	}
+}
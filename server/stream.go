@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// outputEvent is an output message published by a running workflow.
+// The id is the time of the output in nanoseconds, it does not depend on the worker or its restarts.
+type outputEvent struct {
+	ID         uint64
+	AID        string
+	WID        string
+	RoutingKey string
+	Body       []byte
+}
+
+// outputSub is a subscriber to the output of a workflow
+type outputSub struct {
+	aid, wid string
+	keys     []string // the routing keys of the outputs watched on the transport
+	events   chan outputEvent
+}
+
+// outputHub dispatch the published output messages to the stream subscribers.
+// The last events are kept to resume a stream from the last received event id.
+type outputHub struct {
+	mu      sync.Mutex
+	lastID  uint64 // the ids are increasing even for the outputs of the same time
+	history []outputEvent
+	next    int
+	subs    map[*outputSub]struct{}
+}
+
+func newOutputHub(historySize int) *outputHub {
+	if historySize < 1 {
+		historySize = 1
+	}
+	return &outputHub{
+		history: make([]outputEvent, 0, historySize),
+		subs:    make(map[*outputSub]struct{}),
+	}
+}
+
+// publish an output message of a workflow created at the given time
+func (h *outputHub) publish(aid, wid, routingKey string, body []byte, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id := uint64(at.UnixNano())
+	if id <= h.lastID {
+		id = h.lastID + 1
+	}
+	h.lastID = id
+	e := outputEvent{ID: id, AID: aid, WID: wid, RoutingKey: routingKey, Body: body}
+	if len(h.history) < cap(h.history) {
+		h.history = append(h.history, e)
+	} else {
+		h.history[h.next] = e
+		h.next = (h.next + 1) % len(h.history)
+	}
+
+	for s := range h.subs {
+		if s.aid != aid || s.wid != wid {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			// too slow, the client must resume from its last event id
+			delete(h.subs, s)
+			close(s.events)
+		}
+	}
+}
+
+// subscribe to the output of a workflow of the account.
+// The kept events newer than lastID are returned to be sent first.
+func (h *outputHub) subscribe(aid, wid string, lastID uint64) (*outputSub, []outputEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var backlog []outputEvent
+	if lastID > 0 {
+		for _, l := range [][]outputEvent{h.history[h.next:], h.history[:h.next]} {
+			for _, e := range l {
+				if e.ID > lastID && e.AID == aid && e.WID == wid {
+					backlog = append(backlog, e)
+				}
+			}
+		}
+	}
+	s := &outputSub{aid: aid, wid: wid, events: make(chan outputEvent, 64)}
+	h.subs[s] = struct{}{}
+	return s, backlog
+}
+
+func (h *outputHub) unsubscribe(s *outputSub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, exist := h.subs[s]; exist {
+		delete(h.subs, s)
+		close(s.events)
+	}
+}
+
+// tokenFromQuery use the access_token query parameter as the Authorization header.
+// Browsers cannot set headers on EventSource and WebSocket.
+// The parameter is removed from the request to not be logged.
+func tokenFromQuery(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		query := req.URL.Query()
+		if token := query.Get("access_token"); token != "" {
+			if req.Header.Get("Authorization") == "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+			query.Del("access_token")
+			req.URL.RawQuery = query.Encode()
+			req.RequestURI = req.URL.RequestURI()
+		}
+		return next(c)
+	}
+}
+
+// outputKeys return the routing keys of the output sensors of the workflow
+func outputKeys(w dbWorkflow) ([]string, error) {
+	graph, err := newFlowGraph(w)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	seen := make(map[string]bool)
+	for _, n := range graph.Flow {
+		if n == nil || n.Operator != "output" || seen[n.ID] {
+			continue
+		}
+		seen[n.ID] = true
+		keys = append(keys, w.AccountID.String()+"."+n.ID)
+	}
+	return keys, nil
+}
+
+// observeOutput publish on the stream the output message received from the transport,
+// the workflow may run on another worker. The outputs of the local workflows are published by their hook.
+func (h *handler) observeOutput(m Message) {
+	wid := m.MessageID
+	if wid == "" || h.isLocal(wid) {
+		return
+	}
+	at := time.Now()
+	if ts, ok := m.Headers["timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			at = t
+		}
+	}
+	aid := strings.SplitN(m.RoutingKey, ".", 2)[0]
+	h.stream.publish(aid, wid, m.RoutingKey, m.Body, at)
+}
+
+// streamSubscribe check the workflow belong to the account and subscribe to its outputs.
+// The outputs are watched on the transport as the workflow may run on another worker.
+// The stream resume after the Last-Event-ID header or the last_event_id query parameter.
+func (h *handler) streamSubscribe(c echo.Context) (*outputSub, []outputEvent, error) {
+	account := c.Get("account").(auth.Account)
+	wid := c.Param("wid")
+
+	w, err := h.findWorkflow(account.ID, wid)
+	if err != nil {
+		return nil, nil, c.NoContent(http.StatusNotFound)
+	}
+	keys, err := outputKeys(w)
+	if err != nil {
+		return nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{"message": err.Error()})
+	}
+
+	last := c.Request().Header.Get("Last-Event-ID")
+	if last == "" {
+		last = c.QueryParam("last_event_id")
+	}
+	var lastID uint64
+	if last != "" {
+		var err error
+		lastID, err = strconv.ParseUint(last, 10, 64)
+		if err != nil {
+			return nil, nil, c.JSON(http.StatusBadRequest, map[string]string{"message": "invalid last event id"})
+		}
+	}
+
+	s, backlog := h.stream.subscribe(account.ID.String(), wid, lastID)
+	s.keys = keys
+	h.router.watch(keys)
+	return s, backlog, nil
+}
+
+// streamUnsubscribe stop the stream and the watch of the outputs
+func (h *handler) streamUnsubscribe(s *outputSub) {
+	h.stream.unsubscribe(s)
+	h.router.unwatch(s.keys)
+}
+
+// getOutputStream push the output messages of a running workflow with Server-Sent Events
+func (h *handler) getOutputStream(c echo.Context) error {
+	s, backlog, err := h.streamSubscribe(c)
+	if s == nil {
+		return err
+	}
+	defer h.streamUnsubscribe(s)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+
+	write := func(e outputEvent) error {
+		_, err := fmt.Fprintf(res, "id: %d\nevent: output\ndata: %s\n\n", e.ID, e.Body)
+		res.Flush()
+		return err
+	}
+	for _, e := range backlog {
+		if err := write(e); err != nil {
+			return nil
+		}
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case e, ok := <-s.events:
+			if !ok {
+				return nil
+			}
+			if err := write(e); err != nil {
+				return nil
+			}
+		}
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// getOutputWebSocket push the output messages of a running workflow on a WebSocket.
+// Each message is a json object with the event id and the output message.
+func (h *handler) getOutputWebSocket(c echo.Context) error {
+	s, backlog, err := h.streamSubscribe(c)
+	if s == nil {
+		return err
+	}
+	defer h.streamUnsubscribe(s)
+
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return nil
+	}
+	defer ws.Close()
+
+	// read the control messages until the client close the connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := ws.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(e outputEvent) error {
+		ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return ws.WriteJSON(struct {
+			ID     uint64          `json:"id"`
+			Output json.RawMessage `json:"output"`
+		}{e.ID, e.Body})
+	}
+	for _, e := range backlog {
+		if err := write(e); err != nil {
+			return nil
+		}
+	}
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case <-closed:
+			return nil
+		case <-ping.C:
+			if err := ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return nil
+			}
+		case e, ok := <-s.events:
+			if !ok {
+				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(time.Second))
+				return nil
+			}
+			if err := write(e); err != nil {
+				return nil
+			}
+		}
+	}
+}
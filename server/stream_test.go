@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestOutputHubResume(t *testing.T) {
+	hub := newOutputHub(5)
+	at := time.Unix(1000, 0)
+	for i := 0; i < 5; i++ {
+		hub.publish("a", "w", "a.s", []byte("{}"), at.Add(time.Duration(i)*time.Second))
+	}
+	hub.publish("a", "other", "a.s", []byte("{}"), at.Add(5*time.Second))
+	hub.publish("b", "w", "b.s", []byte("{}"), at.Add(6*time.Second))
+
+	// only the kept events of the workflow newer than the last id are resumed
+	last := uint64(at.Add(2 * time.Second).UnixNano())
+	s, backlog := hub.subscribe("a", "w", last)
+	if len(backlog) != 2 || backlog[0].ID != uint64(at.Add(3*time.Second).UnixNano()) || backlog[1].ID <= backlog[0].ID {
+		t.Errorf("wrong backlog %+v", backlog)
+	}
+
+	hub.publish("a", "w", "a.s", []byte(`{"id":"s"}`), at.Add(7*time.Second))
+	hub.publish("b", "w", "b.s", []byte("{}"), at.Add(8*time.Second))
+	e := <-s.events
+	if e.ID != uint64(at.Add(7*time.Second).UnixNano()) || string(e.Body) != `{"id":"s"}` {
+		t.Errorf("wrong event %+v", e)
+	}
+	select {
+	case e := <-s.events:
+		t.Errorf("event of another account received %+v", e)
+	default:
+	}
+
+	hub.unsubscribe(s)
+	if _, ok := <-s.events; ok {
+		t.Error("events not closed after unsubscribe")
+	}
+}
+
+func TestOutputHubIDs(t *testing.T) {
+	hub := newOutputHub(5)
+	s, _ := hub.subscribe("a", "w", 0)
+	defer hub.unsubscribe(s)
+
+	// the outputs of the same time or older have increasing ids
+	at := time.Unix(1000, 0)
+	hub.publish("a", "w", "a.s1", []byte("{}"), at)
+	hub.publish("a", "w", "a.s2", []byte("{}"), at)
+	hub.publish("a", "w", "a.s3", []byte("{}"), at.Add(-time.Second))
+	first, second, third := <-s.events, <-s.events, <-s.events
+	if first.ID != uint64(at.UnixNano()) || second.ID != first.ID+1 || third.ID != second.ID+1 {
+		t.Errorf("wrong ids %d %d %d", first.ID, second.ID, third.ID)
+	}
+}
+
+func TestOutputHubSlowSubscriber(t *testing.T) {
+	hub := newOutputHub(10)
+	s, _ := hub.subscribe("a", "w", 0)
+	for i := 0; i < cap(s.events)+1; i++ {
+		hub.publish("a", "w", "a.s", []byte("{}"), time.Now())
+	}
+	n := 0
+	for range s.events {
+		n++
+	}
+	if n != cap(s.events) {
+		t.Errorf("expected %d events before the drop, got %d", cap(s.events), n)
+	}
+	// unsubscribe after the drop must not panic
+	hub.unsubscribe(s)
+}
+
+func TestTokenFromQuery(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/workflow/outputs/w/stream?access_token=secret&last_event_id=3", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	err := tokenFromQuery(func(c echo.Context) error {
+		if a := c.Request().Header.Get("Authorization"); a != "Bearer secret" {
+			t.Errorf("wrong authorization %q", a)
+		}
+		return nil
+	})(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the token is not logged with the uri
+	if req.RequestURI != "/workflow/outputs/w/stream?last_event_id=3" || c.QueryParam("last_event_id") != "3" {
+		t.Errorf("the token should be removed from %s", req.RequestURI)
+	}
+}
+
+func TestObserveOutput(t *testing.T) {
+	mt := newMemoryTransport()
+	h := &handler{
+		workflows: make(map[string]*Workflow),
+		paused:    make(map[string]dbWorkflow),
+		stream:    newOutputHub(10),
+	}
+	h.router = newSensorRouter(mt, "w0")
+	h.router.observe = h.observeOutput
+
+	// the output of a workflow running on another worker
+	s, _ := h.stream.subscribe("a", "w", 0)
+	s.keys = []string{"a.out"}
+	h.router.watch(s.keys)
+
+	at := time.Unix(1000, 0)
+	mt.PublishSensor(Message{
+		RoutingKey: "a.out",
+		MessageID:  "w",
+		Headers:    map[string]interface{}{"timestamp": at.Format(time.RFC3339Nano)},
+		Body:       []byte(`{"hot":true}`),
+	})
+	select {
+	case e := <-s.events:
+		if e.ID != uint64(at.UnixNano()) || string(e.Body) != `{"hot":true}` {
+			t.Errorf("wrong event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the output should be streamed")
+	}
+
+	h.streamUnsubscribe(s)
+	mt.mu.Lock()
+	bound := mt.keys["a.out"]
+	mt.mu.Unlock()
+	if bound {
+		t.Error("the output should be unbound once the stream is closed")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer of the engine
+const instrumentationName = "github.com/fredericalix/yic_workflow-engine/server"
+
+// tracing start the spans of the sensor messages, they are not recorded until TRACING set a provider
+var tracing = trace.NewNoopTracerProvider().Tracer(instrumentationName)
+
+// propagator read and write the W3C traceparent and tracestate headers
+var propagator = propagation.TraceContext{}
+
+// newTracerProvider export the spans to stdout, or to an OpenTelemetry collector with OTLP/HTTP on the
+// endpoint http://localhost:4318/v1/traces. The new traces are sampled with ratio, the others like their parent.
+func newTracerProvider(exporter, endpoint, worker string, ratio float64) (*sdktrace.TracerProvider, error) {
+	var e sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "stdout":
+		e, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		u, perr := url.Parse(endpoint)
+		if perr != nil {
+			return nil, perr
+		}
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(u.Path)}
+		if u.Scheme != "https" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		e, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("unknown TRACING %s, expect stdout or otlp", exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(e),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("workflow-engine"),
+			semconv.ServiceInstanceIDKey.String(worker),
+		)),
+	), nil
+}
+
+// startSpan start a span child of parent, a new trace is started if parent is nil
+func startSpan(parent trace.Span, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) trace.Span {
+	ctx := context.Background()
+	if parent != nil {
+		ctx = trace.ContextWithSpan(ctx, parent)
+	}
+	_, s := tracing.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attrs...))
+	return s
+}
+
+// failSpan record the error on the span, nothing is done if err is nil
+func failSpan(s trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	s.RecordError(err)
+	s.SetStatus(codes.Error, err.Error())
+}
+
+// headerCarrier carry the trace context in the headers of a message.
+// It is also read from the distributed tracing extension of a binary CloudEvents.
+type headerCarrier map[string]interface{}
+
+func (c headerCarrier) Get(key string) string {
+	if v, ok := c[key].(string); ok {
+		return v
+	}
+	v, _ := eventAttribute(c, key)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// injectSpan write the trace context of the span in the headers of a message
+func injectSpan(s trace.Span, headers map[string]interface{}) {
+	propagator.Inject(trace.ContextWithSpan(context.Background(), s), headerCarrier(headers))
+}
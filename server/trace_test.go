@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHeaderCarrier(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, headers := range []map[string]interface{}{
+		{"traceparent": traceparent, "tracestate": "vendor=opaque"},
+		{"cloudEvents_traceparent": traceparent, "cloudEvents_tracestate": "vendor=opaque"},
+		{"cloudEvents:traceparent": traceparent, "cloudEvents:tracestate": "vendor=opaque"},
+	} {
+		ctx := propagator.Extract(context.Background(), headerCarrier(headers))
+		c := trace.SpanContextFromContext(ctx)
+		if !c.IsValid() || !c.IsSampled() || c.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.TraceState().String() != "vendor=opaque" {
+			t.Errorf("wrong context %+v of %v", c, headers)
+		}
+		injected := make(map[string]interface{})
+		propagator.Inject(ctx, headerCarrier(injected))
+		if injected["traceparent"] != traceparent || injected["tracestate"] != "vendor=opaque" {
+			t.Errorf("wrong headers %v", injected)
+		}
+	}
+}
+
+// recordSpans record the spans started until the returned function is called
+func recordSpans() (*tracetest.SpanRecorder, func()) {
+	recorder := tracetest.NewSpanRecorder()
+	tracing = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(instrumentationName)
+	return recorder, func() { tracing = trace.NewNoopTracerProvider().Tracer(instrumentationName) }
+}
+
+// endedSpan return the span ended with the name, nil if none
+func endedSpan(recorder *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, s := range recorder.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTracePropagation(t *testing.T) {
+	recorder, stop := recordSpans()
+	defer stop()
+
+	traceparents := make(chan http.Header, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header
+	}))
+	defer hook.Close()
+
+	graph := testGraph(t, `"hook": {"operator": "send", "values": ["`+hook.URL+`"], "id": "`+outputID+`"}`)
+	aid, wid := graph.AID, graph.ID
+	webhooks := newWebhookDispatcher(1, 16, time.Second, 1, nil)
+	hooks := testHooks
+	hooks.webhook = func(sid, url string, body []byte, s trace.Span) {
+		webhooks.send(aid, wid, sid, url, body, s)
+	}
+	wo, mt, _ := startTestWorkflow(t, graph, hooks)
+	defer wo.Stop()
+
+	const traceID, traceState = "4bf92f3577b34da6a3ce929d0e0e4736", "vendor=opaque"
+	outputs := mt.Watch(aid.String() + "." + outputID)
+	mt.PublishSensor(Message{
+		RoutingKey: aid.String() + "." + sensorID,
+		Headers:    map[string]interface{}{"traceparent": "00-" + traceID + "-00f067aa0ba902b7-01", "tracestate": traceState},
+		Body:       temperature(25),
+	})
+
+	// the trace is continued by the output message and the webhook
+	select {
+	case m := <-outputs:
+		c := trace.SpanContextFromContext(propagator.Extract(context.Background(), headerCarrier(m.Headers)))
+		if c.TraceID().String() != traceID || c.TraceState().String() != traceState {
+			t.Errorf("the output should continue the trace, got %v", m.Headers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output message")
+	}
+	select {
+	case h := <-traceparents:
+		c := trace.SpanContextFromContext(propagator.Extract(context.Background(), propagation.HeaderCarrier(h)))
+		if c.TraceID().String() != traceID || h.Get("tracestate") != traceState {
+			t.Errorf("the webhook should continue the trace, got %v", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook")
+	}
+
+	// the spans of each stage are recorded with their parent
+	parents := map[string]string{
+		"sensor.receive":      "",
+		"workflow.process":    "sensor.receive",
+		"workflow.send_input": "workflow.process",
+		"workflow.compute":    "workflow.process",
+		"output.publish":      "workflow.process",
+		"webhook.send":        "workflow.process",
+	}
+	waitFor(t, func() bool {
+		return endedSpan(recorder, "sensor.receive") != nil && endedSpan(recorder, "webhook.send") != nil
+	})
+	for name, parent := range parents {
+		s := endedSpan(recorder, name)
+		if s == nil {
+			t.Errorf("span %s not ended", name)
+			continue
+		}
+		if s.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s of another trace", name)
+		}
+		if parent != "" {
+			if p := endedSpan(recorder, parent); p != nil && s.Parent().SpanID() != p.SpanContext().SpanID() {
+				t.Errorf("the parent of %s should be %s", name, parent)
+			}
+		}
+	}
+	if s := endedSpan(recorder, "sensor.receive"); s != nil && s.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("the received span should be a child of the publisher")
+	}
+}
+
+func TestOTLPTracerProvider(t *testing.T) {
+	requests := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- r.URL.Path + " " + r.Header.Get("Content-Type"):
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	provider, err := newTracerProvider("otlp", collector.URL+"/v1/traces", "w0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s := provider.Tracer(instrumentationName).Start(context.Background(), "workflow.process")
+	s.End()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-requests:
+		if r != "/v1/traces application/x-protobuf" {
+			t.Errorf("wrong request %s", r)
+		}
+	default:
+		t.Fatal("the spans should be exported to the collector")
+	}
+
+	if _, err := newTracerProvider("zipkin", "", "w0", 1); err == nil {
+		t.Error("an unknown exporter should be refused")
+	}
+}
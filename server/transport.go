@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Transport carry the messages of the engine:
+// the sensor messages consumed by the workflows, their output messages, the dead letters,
+// the workflow commands between the workers, the account deletions and the latest sensor values.
+// The implementations reconnect by themselves, the consumers never return.
+type Transport interface {
+	// Wait until the transport is connected
+	Wait()
+
+	// BindSensor start to deliver the sensor messages of the routing key <aid>.<sensorID> to ConsumeSensors
+	BindSensor(key string)
+	// UnbindSensor stop to deliver the sensor messages of the routing key
+	UnbindSensor(key string)
+	// PublishSensor publish a sensor message to every worker using it
+	PublishSensor(m Message) error
+	// ConsumeSensors call handle for each sensor message of the bound routing keys,
+	// each delivery must be acknowledged or rejected
+	ConsumeSensors(handle func(Delivery))
+	// PublishDeadLetter publish a sensor message rejected by a workflow, with its original routing key
+	PublishDeadLetter(m Message) error
+	// OpenOutputs open a session to publish the output messages on the sensors
+	OpenOutputs() (OutputSession, error)
+
+	// PublishCommand publish a workflow command with the routing key <worker>.<aid>.<wid>.<command>
+	PublishCommand(key string, m Message) error
+	// ConsumeCommands call handle for each workflow command of every worker
+	ConsumeCommands(handle func(Delivery))
+	// ConsumeAccountDeletions call handle for each deleted account, the routing key is <aid>.delete
+	ConsumeAccountDeletions(handle func(Delivery))
+
+	// LatestSensors request the latest values of the sensors of the account,
+	// each value is a map with the aid, sid and data keys
+	LatestSensors(ctx context.Context, aid uuid.UUID) (<-chan map[string]interface{}, error)
+}
+
+// Message sent or received on the transport
+type Message struct {
+	RoutingKey    string
+	Headers       map[string]interface{}
+	ContentType   string
+	MessageID     string
+	CorrelationID string
+	Timestamp     time.Time
+	Body          []byte
+}
+
+// acknowledger settle a delivery on the transport
+type acknowledger interface {
+	Ack() error
+	// Reject the delivery, it is delivered again with requeue or dead lettered by the transport otherwise
+	Reject(requeue bool) error
+}
+
+// Delivery is a received message
+type Delivery struct {
+	Message
+	acker acknowledger // nil if the transport does not need acknowledgements
+}
+
+// Ack the delivery once processed
+func (d Delivery) Ack() error {
+	if d.acker == nil {
+		return nil
+	}
+	return d.acker.Ack()
+}
+
+// Reject the delivery, it is delivered again with requeue
+func (d Delivery) Reject(requeue bool) error {
+	if d.acker == nil {
+		return nil
+	}
+	return d.acker.Reject(requeue)
+}
+
+// Confirmation of a published output message by the transport
+type Confirmation struct {
+	Tag uint64
+	Ack bool
+}
+
+// Return is a mandatory output message not routed to any consumer
+type Return struct {
+	RoutingKey string
+	MessageID  string
+	Reason     string
+}
+
+// OutputSession publish the output messages, every message is confirmed or rejected by the transport.
+// The messages not confirmed when the session is closed may be lost.
+type OutputSession interface {
+	// Publish the message, the tag identify its confirmation. The tags start at 1 in each session.
+	Publish(m Message, mandatory bool) (tag uint64, err error)
+	Confirms() <-chan Confirmation
+	// Returns report the mandatory messages not routed, only if requested
+	Returns() <-chan Return
+	// Closed receive the error closing the session
+	Closed() <-chan error
+	Close() error
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/streadway/amqp"
+)
+
+// deadLetterExchange receive the sensor messages a workflow could not use
+const deadLetterExchange = "sensors.dead"
+
+// amqpTransport carry the messages on RabbitMQ:
+// the sensor and output messages on the sensors exchange, the dead letters on the sensors.dead exchange,
+// the commands on the workflow exchange, the account deletions on the account exchange
+// and the latest sensor values with the rpc_sensors_latest queue.
+type amqpTransport struct {
+	mq         *amqpManager
+	workerName string
+	prefetch   int
+	cmdPub     *amqpPublisher // publish on the workflow exchange
+	sensorPub  *amqpPublisher // publish on the sensors exchange
+	deadPub    *amqpPublisher // publish on the dead letter exchange
+
+	mu    sync.Mutex
+	keys  map[string]bool // the bound sensor routing keys
+	ch    *amqp.Channel   // the channel of the sensor consumer, nil while disconnected
+	queue string
+}
+
+// newAMQPTransport start to connect to RabbitMQ in background,
+// at most prefetch sensor messages are delivered and not acknowledged yet
+func newAMQPTransport(uri, workerName string, prefetch int) *amqpTransport {
+	mq := dialAMQP(uri)
+	return &amqpTransport{
+		mq:         mq,
+		workerName: workerName,
+		prefetch:   prefetch,
+		cmdPub:     newAMQPPublisher(mq, declareWorkflowExchange),
+		sensorPub:  newAMQPPublisher(mq, declareSensorsExchange),
+		deadPub:    newAMQPPublisher(mq, declareDeadLetterExchange),
+		keys:       make(map[string]bool),
+	}
+}
+
+func (t *amqpTransport) Wait() {
+	t.mq.wait(nil)
+}
+
+// consumeLoop call consume on each new connection
+func (t *amqpTransport) consumeLoop(what string, consume func(*amqp.Connection) error) {
+	for {
+		if err := consume(t.mq.wait(nil)); err != nil {
+			log.Printf("cannot consume the %s: %v", what, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (t *amqpTransport) BindSensor(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys[key] = true
+	t.bind(key)
+}
+
+func (t *amqpTransport) UnbindSensor(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, key)
+	if t.ch == nil {
+		return
+	}
+	if err := t.ch.QueueUnbind(t.queue, key, "sensors", nil); err != nil {
+		log.Printf("cannot unbind %s: %v", key, err)
+		return
+	}
+	log.Printf("unbind %s", key)
+}
+
+// bind the queue to the routing key, t.mu must be held. Nothing is done while disconnected,
+// every key is bound on reconnection.
+func (t *amqpTransport) bind(key string) {
+	if t.ch == nil {
+		return
+	}
+	err := t.ch.QueueBind(
+		t.queue,   // queue name
+		key,       // routing key
+		"sensors", // exchange
+		false,     // no wait
+		nil,       // args
+	)
+	if err != nil {
+		log.Printf("cannot bind %s: %v", key, err)
+		return
+	}
+	log.Printf("bind to %s", key)
+}
+
+func (t *amqpTransport) PublishSensor(m Message) error {
+	return t.sensorPub.Publish(
+		"sensors",    // exchange
+		m.RoutingKey, // routing key
+		false,        // mandatory
+		false,        // immediate
+		toPublishing(m))
+}
+
+// ConsumeSensors with a single queue for the worker, bound again to every key after each reconnection
+func (t *amqpTransport) ConsumeSensors(handle func(Delivery)) {
+	t.consumeLoop("sensor messages", func(conn *amqp.Connection) error {
+		return t.consumeSensors(conn, handle)
+	})
+}
+
+// consumeSensors until the connection is closed
+func (t *amqpTransport) consumeSensors(conn *amqp.Connection, handle func(Delivery)) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+	defer ch.Close()
+
+	err = declareSensorsExchange(ch)
+	if err != nil {
+		return fmt.Errorf("failed to declare an exchange: %v", err)
+	}
+	err = declareDeadLetterExchange(ch)
+	if err != nil {
+		return fmt.Errorf("failed to declare the dead letter exchange: %v", err)
+	}
+
+	q, err := ch.QueueDeclare(
+		fmt.Sprintf("%s_sensors_%s", t.workerName, randName(6)), // name
+		false, // durable
+		true,  // delete when usused
+		true,  // exclusive
+		false, // no-wait
+		// the rejected messages go to the dead letter exchange if they cannot be published there
+		amqp.Table{"x-dead-letter-exchange": deadLetterExchange}, // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a queue: %v", err)
+	}
+
+	err = ch.Qos(t.prefetch, 0, false)
+	if err != nil {
+		return fmt.Errorf("failed to set the prefetch: %v", err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name,       // queue
+		t.workerName, // consumer
+		false,        // auto ack
+		true,         // exclusive
+		false,        // no local
+		false,        // no wait
+		nil,          // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register a consumer: %v", err)
+	}
+
+	t.mu.Lock()
+	t.ch, t.queue = ch, q.Name
+	for key := range t.keys {
+		t.bind(key)
+	}
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.ch = nil
+		t.mu.Unlock()
+	}()
+
+	log.Println("Ready wait for 'sensor' events")
+	for d := range msgs {
+		handle(fromAMQP(d, false))
+	}
+	return nil
+}
+
+func (t *amqpTransport) PublishDeadLetter(m Message) error {
+	return t.deadPub.Publish(
+		deadLetterExchange, // exchange
+		m.RoutingKey,       // routing key
+		false,              // mandatory
+		false,              // immediate
+		toPublishing(m))
+}
+
+// OpenOutputs wait the connection and open a channel in confirm mode
+func (t *amqpTransport) OpenOutputs() (OutputSession, error) {
+	ch, err := t.mq.wait(nil).Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+	if err := declareSensorsExchange(ch); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to declare an exchange: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, fmt.Errorf("failed to enable the confirm mode: %v", err)
+	}
+
+	s := &amqpOutputSession{
+		ch:       ch,
+		confirms: make(chan Confirmation, maxInFlight+1),
+		returns:  make(chan Return, 64),
+		closed:   make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, maxInFlight+1))
+	returns := ch.NotifyReturn(make(chan amqp.Return, 64))
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		for c := range confirms {
+			select {
+			case s.confirms <- Confirmation{Tag: c.DeliveryTag, Ack: c.Ack}:
+			case <-s.done:
+				return
+			}
+		}
+		close(s.confirms)
+	}()
+	go func() {
+		for r := range returns {
+			select {
+			case s.returns <- Return{RoutingKey: r.RoutingKey, MessageID: r.MessageId, Reason: r.ReplyText}:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		if err, ok := <-closed; ok {
+			s.closed <- err
+		} else {
+			s.closed <- errors.New("channel closed")
+		}
+	}()
+	return s, nil
+}
+
+// amqpOutputSession publish on a channel in confirm mode
+type amqpOutputSession struct {
+	ch       *amqp.Channel
+	tag      uint64 // the delivery tags start at 1 on each channel
+	confirms chan Confirmation
+	returns  chan Return
+	closed   chan error
+	done     chan struct{}
+}
+
+func (s *amqpOutputSession) Publish(m Message, mandatory bool) (uint64, error) {
+	err := s.ch.Publish(
+		"sensors",    // exchange
+		m.RoutingKey, // routing key
+		mandatory,    // mandatory
+		false,        // immediate
+		toPublishing(m))
+	if err != nil {
+		return 0, err
+	}
+	s.tag++
+	return s.tag, nil
+}
+
+func (s *amqpOutputSession) Confirms() <-chan Confirmation { return s.confirms }
+func (s *amqpOutputSession) Returns() <-chan Return        { return s.returns }
+func (s *amqpOutputSession) Closed() <-chan error          { return s.closed }
+
+func (s *amqpOutputSession) Close() error {
+	close(s.done)
+	return s.ch.Close()
+}
+
+func (t *amqpTransport) PublishCommand(key string, m Message) error {
+	return t.cmdPub.Publish(
+		"workflow", // exchange
+		key,        // routing key
+		false,      // mandatory
+		false,      // immediate
+		toPublishing(m))
+}
+
+// ConsumeCommands with an exclusive queue bound to every routing key, declared again after each reconnection
+func (t *amqpTransport) ConsumeCommands(handle func(Delivery)) {
+	t.consumeLoop("workflow commands", func(conn *amqp.Connection) error {
+		return t.consumeCommands(conn, handle)
+	})
+}
+
+// consumeCommands until the connection is closed
+func (t *amqpTransport) consumeCommands(conn *amqp.Connection, handle func(Delivery)) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+	defer ch.Close()
+
+	err = declareWorkflowExchange(ch)
+	if err != nil {
+		return fmt.Errorf("failed to declare an exchange: %v", err)
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when usused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a queue: %v", err)
+	}
+
+	// Get every routing key
+	err = ch.QueueBind(
+		q.Name,     // queue name
+		"#",        // routing key
+		"workflow", // exchange
+		false,      // no wait
+		nil,        // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to bind a queue: %v", err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name,       // queue
+		t.workerName, // consumer
+		true,         // auto ack
+		true,         // exclusive
+		false,        // no local
+		false,        // no wait
+		nil,          // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register a consumer: %v", err)
+	}
+
+	log.Println("Ready wait for 'workflow' command events")
+	for d := range msgs {
+		handle(fromAMQP(d, true))
+	}
+	return nil
+}
+
+// ConsumeAccountDeletions with the durable queue shared by the workers, declared again after each reconnection
+func (t *amqpTransport) ConsumeAccountDeletions(handle func(Delivery)) {
+	t.consumeLoop("account deletions", func(conn *amqp.Connection) error {
+		return t.consumeAccountDeletions(conn, handle)
+	})
+}
+
+// consumeAccountDeletions until the connection is closed
+func (t *amqpTransport) consumeAccountDeletions(conn *amqp.Connection, handle func(Delivery)) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %v", err)
+	}
+	defer ch.Close()
+
+	err = ch.ExchangeDeclare(
+		"account", // name
+		"fanout",  // type
+		true,      // durable
+		false,     // auto-deleted
+		false,     // internal
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a account exchange: %v", err)
+	}
+
+	q, err := ch.QueueDeclare(
+		"workflow-engine_account", // name
+		true,                      // durable
+		false,                     // delete when usused
+		false,                     // exclusive
+		false,                     // no-wait
+		nil,                       // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare a queue: %v", err)
+	}
+
+	err = ch.QueueBind(
+		q.Name,     // queue name
+		"#.delete", // routing key
+		"account",  // exchange
+		false,      // no-wait
+		nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind a queue: %v", err)
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register a consumer: %v", err)
+	}
+
+	log.Println("Ready, wait on topic 'account'")
+	for d := range msgs {
+		handle(fromAMQP(d, false))
+	}
+	return nil
+}
+
+// LatestSensors call the rpc_sensors_latest service, errNotConnected is returned while disconnected
+func (t *amqpTransport) LatestSensors(ctx context.Context, aid uuid.UUID) (<-chan map[string]interface{}, error) {
+	conn := t.mq.current()
+	if conn == nil {
+		return nil, errNotConnected
+	}
+	return findLatestSensors(ctx, conn, aid, "")
+}
+
+func findLatestSensors(ctx context.Context, conn *amqp.Connection, aid uuid.UUID, corrID string) (<-chan map[string]interface{}, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name
+		false, // durable
+		true,  // delete when usused
+		true,  // exclusive
+		false, // noWait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	request := struct {
+		AID uuid.UUID `json:"aid"`
+	}{aid}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Publish(
+		"",                   // exchange
+		"rpc_sensors_latest", // routing key
+		false,                // mandatory
+		false,                // immediate
+		amqp.Publishing{
+			ContentType:   "text/plain",
+			CorrelationId: corrID,
+			ReplyTo:       q.Name,
+			Body:          body,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	latests := make(chan map[string]interface{}, 16)
+
+	go func() {
+		defer func() {
+			ch.QueueDelete(q.Name, false, false, false)
+			ch.Close()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case d := <-msgs:
+				if corrID == d.CorrelationId {
+					var s []map[string]interface{}
+					err := json.Unmarshal(d.Body, &s)
+					if err != nil {
+						log.Println(err)
+						return
+					}
+					d.Ack(false)
+					for _, ms := range s {
+						latests <- ms
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	return latests, nil
+}
+
+// amqpAcker settle an AMQP delivery
+type amqpAcker struct {
+	d amqp.Delivery
+}
+
+func (a amqpAcker) Ack() error                { return a.d.Ack(false) }
+func (a amqpAcker) Reject(requeue bool) error { return a.d.Nack(false, requeue) }
+
+// fromAMQP convert the delivery, the deliveries of an auto ack consumer need no acknowledgement
+func fromAMQP(d amqp.Delivery, autoAck bool) Delivery {
+	delivery := Delivery{
+		Message: Message{
+			RoutingKey:    d.RoutingKey,
+			Headers:       d.Headers,
+			ContentType:   d.ContentType,
+			MessageID:     d.MessageId,
+			CorrelationID: d.CorrelationId,
+			Timestamp:     d.Timestamp,
+			Body:          d.Body,
+		},
+	}
+	if !autoAck {
+		delivery.acker = amqpAcker{d}
+	}
+	return delivery
+}
+
+// toPublishing convert the message to a persistent AMQP message
+func toPublishing(m Message) amqp.Publishing {
+	return amqp.Publishing{
+		DeliveryMode:  amqp.Persistent,
+		Headers:       toTable(m.Headers),
+		ContentType:   m.ContentType,
+		MessageId:     m.MessageID,
+		CorrelationId: m.CorrelationID,
+		Timestamp:     m.Timestamp,
+		Body:          m.Body,
+	}
+}
+
+// toTable convert the headers and their nested maps to AMQP tables
+func toTable(m map[string]interface{}) amqp.Table {
+	if m == nil {
+		return nil
+	}
+	t := make(amqp.Table, len(m))
+	for k, v := range m {
+		t[k] = toTableValue(v)
+	}
+	return t
+}
+
+func toTableValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return toTable(v)
+	case amqp.Table:
+		return toTable(v)
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i := range v {
+			a[i] = toTableValue(v[i])
+		}
+		return a
+	}
+	return v
+}
+
+// declareSensorsExchange declare the exchange of the sensor messages
+func declareSensorsExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		"sensors", // name
+		"topic",   // type
+		true,      // durable
+		false,     // auto-deleted
+		false,     // internal
+		false,     // no-wait
+		nil,       // arguments
+	)
+}
+
+// declareDeadLetterExchange declare the dead letter exchange and the durable queue keeping its messages
+func declareDeadLetterExchange(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		deadLetterExchange, // name
+		"topic",            // type
+		true,               // durable
+		false,              // auto-deleted
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return err
+	}
+	_, err = ch.QueueDeclare(
+		deadLetterExchange, // name
+		true,               // durable
+		false,              // delete when usused
+		false,              // exclusive
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return err
+	}
+	return ch.QueueBind(
+		deadLetterExchange, // queue name
+		"#",                // routing key
+		deadLetterExchange, // exchange
+		false,              // no wait
+		nil,                // args
+	)
+}
+
+// declareWorkflowExchange declare the exchange of the workflow commands
+func declareWorkflowExchange(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(
+		"workflow", // name
+		"topic",    // type
+		true,       // durable
+		false,      // auto-deleted
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	)
+}
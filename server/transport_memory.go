@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// memoryQueueSize is the number of messages queued for each consumer of the memory transport
+const memoryQueueSize = 1024
+
+// memoryTransport carry the messages in process, to run a single worker without broker and in the tests.
+// The output messages are delivered to the workflows using them like the sensor messages,
+// the latest value of each sensor is kept to answer LatestSensors.
+type memoryTransport struct {
+	sensors  chan Delivery
+	commands chan Delivery
+	accounts chan Delivery
+
+	mu          sync.Mutex
+	keys        map[string]bool           // the bound sensor routing keys
+	latest      map[string][]byte         // the last body by routing key
+	watchers    map[string][]chan Message // the messages published by routing key
+	deadLetters []Message
+}
+
+func newMemoryTransport() *memoryTransport {
+	return &memoryTransport{
+		sensors:  make(chan Delivery, memoryQueueSize),
+		commands: make(chan Delivery, memoryQueueSize),
+		accounts: make(chan Delivery, memoryQueueSize),
+		keys:     make(map[string]bool),
+		latest:   make(map[string][]byte),
+		watchers: make(map[string][]chan Message),
+	}
+}
+
+func (t *memoryTransport) Wait() {}
+
+func (t *memoryTransport) BindSensor(key string) {
+	t.mu.Lock()
+	t.keys[key] = true
+	t.mu.Unlock()
+}
+
+func (t *memoryTransport) UnbindSensor(key string) {
+	t.mu.Lock()
+	delete(t.keys, key)
+	t.mu.Unlock()
+}
+
+func (t *memoryTransport) ConsumeSensors(handle func(Delivery)) {
+	for d := range t.sensors {
+		handle(d)
+	}
+}
+
+func (t *memoryTransport) PublishSensor(m Message) error {
+	t.route(m)
+	return nil
+}
+
+// route the message published on the sensors, it returns false if nobody receive it
+func (t *memoryTransport) route(m Message) bool {
+	t.mu.Lock()
+	t.latest[m.RoutingKey] = m.Body
+	bound := t.keys[m.RoutingKey]
+	watchers := t.watchers[m.RoutingKey]
+	for _, w := range watchers {
+		select {
+		case w <- m:
+		default:
+		}
+	}
+	t.mu.Unlock()
+
+	if bound {
+		t.sensors <- Delivery{Message: m, acker: &memoryAcker{t: t, queue: t.sensors, m: m}}
+	}
+	return bound || len(watchers) > 0
+}
+
+// Watch return the messages published on the sensors with the routing key,
+// the messages are dropped when the channel is full
+func (t *memoryTransport) Watch(key string) <-chan Message {
+	w := make(chan Message, 64)
+	t.mu.Lock()
+	t.watchers[key] = append(t.watchers[key], w)
+	t.mu.Unlock()
+	return w
+}
+
+func (t *memoryTransport) PublishDeadLetter(m Message) error {
+	t.mu.Lock()
+	t.deadLetters = append(t.deadLetters, m)
+	t.mu.Unlock()
+	return nil
+}
+
+// DeadLetters return the dead lettered messages
+func (t *memoryTransport) DeadLetters() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message(nil), t.deadLetters...)
+}
+
+func (t *memoryTransport) OpenOutputs() (OutputSession, error) {
+	return &memoryOutputSession{
+		t:        t,
+		confirms: make(chan Confirmation, maxInFlight+1),
+		returns:  make(chan Return, 64),
+		closed:   make(chan error),
+	}, nil
+}
+
+func (t *memoryTransport) PublishCommand(key string, m Message) error {
+	m.RoutingKey = key
+	t.commands <- Delivery{Message: m}
+	return nil
+}
+
+func (t *memoryTransport) ConsumeCommands(handle func(Delivery)) {
+	for d := range t.commands {
+		handle(d)
+	}
+}
+
+// PublishAccountDeleted publish the deletion of the account
+func (t *memoryTransport) PublishAccountDeleted(aid uuid.UUID) {
+	m := Message{RoutingKey: aid.String() + ".delete"}
+	t.accounts <- Delivery{Message: m, acker: &memoryAcker{t: t, queue: t.accounts, m: m}}
+}
+
+func (t *memoryTransport) ConsumeAccountDeletions(handle func(Delivery)) {
+	for d := range t.accounts {
+		handle(d)
+	}
+}
+
+// LatestSensors return the last message published on each sensor of the account
+func (t *memoryTransport) LatestSensors(ctx context.Context, aid uuid.UUID) (<-chan map[string]interface{}, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	prefix := aid.String() + "."
+	latests := make(chan map[string]interface{}, len(t.latest))
+	for key, body := range t.latest {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		var data interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			continue
+		}
+		latests <- map[string]interface{}{
+			"aid":  aid.String(),
+			"sid":  strings.TrimPrefix(key, prefix),
+			"data": data,
+		}
+	}
+	return latests, nil
+}
+
+// memoryAcker queue again the rejected messages to requeue, the others are dead lettered
+type memoryAcker struct {
+	t     *memoryTransport
+	queue chan Delivery
+	m     Message
+}
+
+func (a *memoryAcker) Ack() error { return nil }
+
+func (a *memoryAcker) Reject(requeue bool) error {
+	if requeue {
+		go func() { a.queue <- Delivery{Message: a.m, acker: a} }()
+		return nil
+	}
+	return a.t.PublishDeadLetter(a.m)
+}
+
+// memoryOutputSession publish the output messages on the sensors of the memory transport,
+// they are confirmed at once
+type memoryOutputSession struct {
+	t        *memoryTransport
+	tag      uint64
+	confirms chan Confirmation
+	returns  chan Return
+	closed   chan error
+}
+
+func (s *memoryOutputSession) Publish(m Message, mandatory bool) (uint64, error) {
+	routed := s.t.route(m)
+	s.tag++
+	s.confirms <- Confirmation{Tag: s.tag, Ack: true}
+	if mandatory && !routed {
+		select {
+		case s.returns <- Return{RoutingKey: m.RoutingKey, MessageID: m.MessageID, Reason: "NO_ROUTE"}:
+		default:
+		}
+	}
+	return s.tag, nil
+}
+
+func (s *memoryOutputSession) Confirms() <-chan Confirmation { return s.confirms }
+func (s *memoryOutputSession) Returns() <-chan Return        { return s.returns }
+func (s *memoryOutputSession) Closed() <-chan error          { return s.closed }
+func (s *memoryOutputSession) Close() error                  { return nil }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	workflow "github.com/fredericalix/yic_workflow-engine"
+	"github.com/gofrs/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the sensor and the output of the test graph
+const sensorID, outputID = "1377959e-97ce-46c1-9715-22c34bb9afbe", "1949f63d-5e40-45bb-9d31-13ab52b5e92a"
+
+// testGraph output hot when the temperature is greater than 20, the nodes "<key>": {...} are added
+func testGraph(t *testing.T, nodes ...string) *workflow.FlowGraph {
+	graph := &workflow.FlowGraph{ID: uuid.Must(uuid.NewV4()), AID: uuid.Must(uuid.NewV4()), Name: "memory"}
+	flow := `{
+		"temp": {"operator": "input", "type": "float", "name": "temperature", "id": "` + sensorID + `"},
+		"limit": {"operator": "const", "type": "float", "ComputedValue": 20},
+		"op": {"operator": "gt", "inputs": ["temp", "limit"]},
+		"hot": {"operator": "output", "type": "bool", "name": "hot", "inputs": ["op"], "id": "` + outputID + `"}`
+	for _, n := range nodes {
+		flow += ",\n" + n
+	}
+	if err := json.Unmarshal([]byte(flow+"}"), &graph.Flow); err != nil {
+		t.Fatal(err)
+	}
+	return graph
+}
+
+// startTestWorkflow run the graph on a new memory transport, the outputs are published at once
+func startTestWorkflow(t *testing.T, graph *workflow.FlowGraph, hooks workflowHooks) (*Workflow, *memoryTransport, *outputPublisher) {
+	mt := newMemoryTransport()
+	router := newSensorRouter(mt, "w0")
+	pub := newOutputPublisher(mt, 16, true, "")
+	go pub.run()
+	wo, err := newWorkflow(mt, router, pub, graph, hooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wo.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	return wo, mt, pub
+}
+
+// testHooks do nothing
+var testHooks = workflowHooks{
+	saveState: func(workflow.Snapshot) {},
+	published: func(string, map[string]interface{}, []byte) {},
+	webhook:   func(string, string, []byte, trace.Span) {},
+}
+
+// temperature is a sensor message of the test graph
+func temperature(v float64) []byte {
+	return []byte(fmt.Sprintf(`{"created_at": "%s", "temperature": %v}`, time.Now().Format(time.RFC3339Nano), v))
+}
+
+func TestMemoryTransportWorkflow(t *testing.T) {
+	graph := testGraph(t)
+	aid, wid := graph.AID, graph.ID
+
+	wo, mt, pub := startTestWorkflow(t, graph, testHooks)
+	defer wo.Stop()
+
+	outputs := mt.Watch(aid.String() + "." + outputID)
+	if !mt.route(Message{RoutingKey: aid.String() + "." + sensorID, Body: temperature(25)}) {
+		t.Fatal("the sensor message should be routed to the workflow")
+	}
+	select {
+	case m := <-outputs:
+		var out map[string]interface{}
+		if err := json.Unmarshal(m.Body, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out["hot"] != true || m.MessageID != wid.String() {
+			t.Errorf("wrong output %s of %s", m.Body, m.MessageID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no output message")
+	}
+
+	// a message the workflow cannot decode is dead lettered
+	mt.PublishSensor(Message{RoutingKey: aid.String() + "." + sensorID, Body: []byte("not json")})
+	waitFor(t, func() bool { return len(mt.DeadLetters()) > 0 })
+	dead := mt.DeadLetters()
+	if len(dead) != 1 || dead[0].Headers["x-workflow-id"] != wid.String() {
+		t.Errorf("expected a dead letter of the workflow, got %v", dead)
+	}
+
+	// the latest values of the sensors of the account
+	latests, err := mt.LatestSensors(context.Background(), aid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(latests); n != 1 {
+		t.Errorf("expected the latest output message, got %d messages", n)
+	}
+
+	waitFor(t, func() bool { return pub.workflowStats(wid.String()).Confirmed > 0 })
+	if s := pub.workflowStats(wid.String()); s.Confirmed != 1 || s.Returned != 0 {
+		t.Errorf("wrong stats %+v", s)
+	}
+}
+
+func TestWorkflowRunFailure(t *testing.T) {
+	graph := testGraph(t)
+	mt := newMemoryTransport()
+	router := &sensorRouter{transport: mt, workerName: "w0", routes: make(map[string]map[*Workflow]struct{}), watches: make(map[string]int)}
+	wo, err := newWorkflow(mt, router, newOutputPublisher(mt, 16, true, ""), graph, testHooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &countAcker{}
+	router.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: graph.AID.String() + "." + sensorID, Body: temperature(25)}})
+
+	// the graph cannot be built again to restore the state
+	inputs := graph.Inputs
+	graph.Inputs = nil
+	graph.Flow["broken"] = &workflow.FlowNode{Operator: "input"}
+	if err := wo.run(&workflow.Snapshot{}); err == nil {
+		t.Fatal("the workflow should not run")
+	}
+	graph.Inputs = inputs
+	delete(graph.Flow, "broken")
+
+	// the workflow is stopped like a running one, the dispatched message is released
+	wo.Stop()
+	if ack.acks != 1 || len(router.routes) != 0 {
+		t.Errorf("expected the message acked and no route, got %d acks and %v", ack.acks, router.routes)
+	}
+}
+
+// nackingTransport reject the first output messages published
+type nackingTransport struct {
+	*memoryTransport
+	nacks int32
+}
+
+func (t *nackingTransport) OpenOutputs() (OutputSession, error) {
+	s, err := t.memoryTransport.OpenOutputs()
+	if err != nil {
+		return nil, err
+	}
+	return &nackingSession{s.(*memoryOutputSession), t}, nil
+}
+
+type nackingSession struct {
+	*memoryOutputSession
+	t *nackingTransport
+}
+
+func (s *nackingSession) Publish(m Message, mandatory bool) (uint64, error) {
+	if atomic.AddInt32(&s.t.nacks, -1) < 0 {
+		return s.memoryOutputSession.Publish(m, mandatory)
+	}
+	s.tag++
+	s.confirms <- Confirmation{Tag: s.tag, Ack: false}
+	return s.tag, nil
+}
+
+func TestWorkflowRepublish(t *testing.T) {
+	graph := testGraph(t)
+	key := graph.AID.String() + "." + sensorID
+	mt := &nackingTransport{memoryTransport: newMemoryTransport(), nacks: 10}
+	outputs := mt.Watch(graph.AID.String() + "." + outputID)
+	router := &sensorRouter{transport: mt, workerName: "w0", routes: make(map[string]map[*Workflow]struct{}), watches: make(map[string]int)}
+	// the buffer is full until the publisher runs
+	pub := newOutputPublisher(mt, 1, true, "")
+	if err := pub.publish(outputMessage{WID: "other", RoutingKey: "a.s", Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	wo, err := newWorkflow(mt, router, pub, graph, testHooks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wo.run(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer wo.Stop()
+
+	// the message is acknowledged when its output is dropped, it would not be computed again
+	ack := chanAcker{make(chan bool, 1)}
+	router.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: key, Body: temperature(25)}})
+	if requeue := <-ack.settled; requeue {
+		t.Error("the message should be acknowledged")
+	}
+	if s := pub.workflowStats(graph.ID.String()); s.Failed != 1 {
+		t.Errorf("the output should be dropped, got %+v", s)
+	}
+
+	// the output rejected by the broker is published again until confirmed,
+	// the message is acknowledged once its output is confirmed
+	<-pub.queue
+	router.dispatch(Delivery{acker: ack, Message: Message{RoutingKey: key, Body: temperature(10)}})
+	waitFor(t, func() bool { return len(pub.queue) > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if len(ack.settled) != 0 {
+		t.Error("the message should not be acknowledged before its output is confirmed")
+	}
+	go pub.run()
+	if requeue := <-ack.settled; requeue {
+		t.Error("the message should be acknowledged")
+	}
+	select {
+	case m := <-outputs:
+		var out map[string]interface{}
+		if err := json.Unmarshal(m.Body, &out); err != nil {
+			t.Fatal(err)
+		}
+		if out["hot"] != false {
+			t.Errorf("wrong output %s", m.Body)
+		}
+	default:
+		t.Fatal("the output should be published")
+	}
+	if n := atomic.LoadInt32(&mt.nacks); n >= 0 {
+		t.Errorf("the output should be rejected 10 times, %d rejections left", n+1)
+	}
+	if s := pub.workflowStats(graph.ID.String()); s.Confirmed != 1 || s.Unconfirmed != 0 {
+		t.Errorf("wrong stats %+v", s)
+	}
+}
+
+// chanAcker send false on ack and requeue on reject, for the deliveries settled by another goroutine
+type chanAcker struct {
+	settled chan bool
+}
+
+func (a chanAcker) Ack() error                { a.settled <- false; return nil }
+func (a chanAcker) Reject(requeue bool) error { a.settled <- requeue; return nil }
+
+// waitFor the condition at most 5 seconds, the test fails on timeout
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// swagger:route GET /workflow/trash Workflow workflowTrash
+//
+// Trash
+//
+// Get the latest version of the deleted workflows of the account which are not purged yet,
+// the last deleted first.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowsResponse
+//       500:
+func (h *handler) getTrash(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+
+	query := `SELECT ` + workflowColumns + `
+	FROM workflow JOIN (
+		SELECT id as maxid, MAX(revision) as maxr
+		FROM workflow
+		WHERE account_id = $1 AND deleted_at IS NOT NULL
+		GROUP BY maxid
+	) w
+	ON w.maxr = revision AND w.maxid = id AND account_id = $1
+	ORDER BY deleted_at DESC
+	;`
+	rows, err := h.db.Query(query, account.ID)
+	if err != nil {
+		c.Logger().Errorf("cannot find deleted workflow for %v: %v", account.ID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	wf := make([]dbWorkflow, 0, 16)
+	for rows.Next() {
+		w, err := scanWorkflow(rows)
+		if err != nil {
+			c.Logger().Errorf("cannot scan deleted workflow for %v: %v", account.ID, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		wf = append(wf, w)
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("cannot find deleted workflow for %v: %v", account.ID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, wf)
+}
+
+// swagger:route POST /workflow/{id}/restore Workflow restoreworkflow
+//
+// Restore Workflow
+//
+// Restore a deleted workflow from the trash with all its versions and start it again.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: workflowResponse
+//       400:
+//       404:
+//       500:
+func (h *handler) postWorkflowRestore(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid, err := uuid.FromString(c.Param("wid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+
+	res, err := h.db.Exec("UPDATE workflow SET deleted_at=NULL WHERE id=$1 AND account_id=$2 AND deleted_at IS NOT NULL;", wid, account.ID)
+	if err != nil {
+		c.Logger().Errorf("cannot restore workflow %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	w, err := h.findWorkflow(account.ID, wid.String())
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	h.sendStarCommand(w)
+
+	setETag(c, w)
+	return c.JSON(http.StatusOK, w)
+}
+
+// purgeTrash delete hourly the workflows deleted for more than the retention,
+// with their state, output history and webhook deliveries. A retention of 0 keep them forever.
+func (h *handler) purgeTrash(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	query := `WITH purged AS (
+		DELETE FROM workflow WHERE deleted_at < $1 RETURNING id
+	), state AS (
+		DELETE FROM workflow_state WHERE id IN (SELECT id FROM purged)
+	), output AS (
+		DELETE FROM workflow_output WHERE workflow_id IN (SELECT id FROM purged)
+	), webhook AS (
+		DELETE FROM workflow_webhook_delivery WHERE workflow_id IN (SELECT id FROM purged)
+	)
+	SELECT COUNT(DISTINCT id) FROM purged;`
+	for {
+		var n int
+		err := h.db.QueryRow(query, time.Now().Add(-retention)).Scan(&n)
+		if err != nil {
+			log.Printf("cannot purge the trash: %v", err)
+		} else if n > 0 {
+			log.Printf("purge %d workflows deleted for more than %v", n, retention)
+		}
+		time.Sleep(time.Hour)
+	}
+}
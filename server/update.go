@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// setETag set the revision of the workflow as the ETag of the response
+func setETag(c echo.Context, w dbWorkflow) {
+	c.Response().Header().Set("ETag", `"`+strconv.Itoa(w.Revision)+`"`)
+}
+
+// ifMatch return the revision in the If-Match header.
+// It returns 0 and the error response if the header is missing or invalid.
+func ifMatch(c echo.Context) (int, error) {
+	h := c.Request().Header.Get("If-Match")
+	if h == "" {
+		return 0, c.JSON(http.StatusPreconditionRequired, map[string]string{"message": "missing If-Match header with the revision of the edited version"})
+	}
+	h = strings.Trim(strings.TrimPrefix(strings.TrimSpace(h), "W/"), `"`)
+	n, err := strconv.Atoi(h)
+	if err != nil || n < 1 {
+		return 0, c.JSON(http.StatusBadRequest, map[string]string{"message": "invalid If-Match header " + h})
+	}
+	return n, nil
+}
+
+// conflict respond 409 with the latest version of the workflow.
+// Without latest version, the workflow is in the trash and must be restored first, or the id is used by another account.
+func (h *handler) conflict(c echo.Context, w dbWorkflow) error {
+	latest, err := h.findWorkflow(w.AccountID, w.ID.String())
+	if err == sql.ErrNoRows {
+		var trashed bool
+		err = h.db.QueryRow("SELECT EXISTS (SELECT 1 FROM workflow WHERE id=$1 AND account_id=$2 AND deleted_at IS NOT NULL);",
+			w.ID, w.AccountID).Scan(&trashed)
+		if err == nil {
+			message := "the workflow id is already used"
+			if trashed {
+				message = "the workflow is in the trash, restore it first with POST /workflow/" + w.ID.String() + "/restore"
+			}
+			return c.JSON(http.StatusConflict, map[string]string{"message": message})
+		}
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", w.AccountID, w.ID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setETag(c, latest)
+	return c.JSON(http.StatusConflict, map[string]interface{}{"message": errConflict.Error(), "latest": latest})
+}
+
+// findEdited return the latest version of the workflow of the request and the revision the client edited.
+// It returns a nil workflow and the error response if the workflow cannot be edited.
+func (h *handler) findEdited(c echo.Context) (*dbWorkflow, int, error) {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid, err := uuid.FromString(c.Param("wid"))
+	if err != nil {
+		return nil, 0, c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	base, err := ifMatch(c)
+	if base == 0 {
+		return nil, 0, err
+	}
+
+	latest, err := h.findWorkflow(account.ID, wid.String())
+	if err == sql.ErrNoRows {
+		return nil, 0, c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		c.Logger().Errorf("cannot find workflow for %v.%v: %v", account.ID, wid, err)
+		return nil, 0, c.NoContent(http.StatusInternalServerError)
+	}
+	if latest.Revision != base {
+		return nil, 0, h.conflict(c, latest)
+	}
+	return &latest, base, nil
+}
+
+// swagger:route PUT /workflow/{id} Workflow putworkflow
+//
+// Update Workflow
+//
+// Replace a workflow by a new version.
+// The If-Match header must be the ETag (revision) of the latest version,
+// the update is rejected with 409 and the latest version if another version has been saved since.
+//
+// Consumes:
+// - application/json
+// Produces:
+// - application/json
+// Schemes: http, https
+// Responses:
+//   200: workflowResponse
+//   400:
+//   404:
+//   409:
+//   428:
+//   500:
+func (h *handler) putWorkflow(c echo.Context) error {
+	latest, base, err := h.findEdited(c)
+	if latest == nil {
+		return err
+	}
+
+	var w dbWorkflow
+	if err := c.Bind(&w); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	w.ID = latest.ID
+	w.AccountID = latest.AccountID
+	w.CreatedAt = time.Now()
+	if w.Worker == "" {
+		w.Worker = latest.Worker
+	}
+
+	return h.saveWorkflow(c, w, base)
+}
+
+// swagger:route PATCH /workflow/{id} Workflow patchworkflow
+//
+// Patch Workflow
+//
+// Apply a JSON Merge Patch (RFC 7396) to the latest version of a workflow and save the result as a new version.
+// A node is changed with {"graph": {"key": {"operator": "..."}}} and removed with {"graph": {"key": null}}.
+// The If-Match header must be the ETag (revision) of the latest version,
+// the patch is rejected with 409 and the latest version if another version has been saved since.
+//
+// Consumes:
+// - application/merge-patch+json
+// Produces:
+// - application/json
+// Schemes: http, https
+// Responses:
+//   200: workflowResponse
+//   400:
+//   404:
+//   409:
+//   415:
+//   428:
+//   500:
+func (h *handler) patchWorkflow(c echo.Context) error {
+	ct, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if ct != "application/merge-patch+json" && ct != echo.MIMEApplicationJSON {
+		return c.JSON(http.StatusUnsupportedMediaType, map[string]string{"message": "expect application/merge-patch+json"})
+	}
+
+	latest, base, err := h.findEdited(c)
+	if latest == nil {
+		return err
+	}
+
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	var patch interface{}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": "the patch must be a json object"})
+	}
+
+	// apply the patch on the json document of the latest version
+	raw, err := json.Marshal(latest)
+	if err != nil {
+		c.Logger().Errorf("cannot marshal workflow %v.%v: %v", latest.AccountID, latest.ID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		c.Logger().Errorf("cannot unmarshal workflow %v.%v: %v", latest.AccountID, latest.ID, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	raw, err = json.Marshal(mergePatch(doc, patch))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+	var w dbWorkflow
+	if err := json.Unmarshal(raw, &w); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+
+	// the identity of the workflow cannot be patched
+	w.ID = latest.ID
+	w.AccountID = latest.AccountID
+	w.Revision = 0
+	w.CreatedAt = time.Now()
+	if w.Worker == "" {
+		w.Worker = latest.Worker
+	}
+
+	return h.saveWorkflow(c, w, base)
+}
+
+// mergePatch apply a JSON Merge Patch (RFC 7396) to a decoded json document and return the result.
+// The target may be modified.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = mergePatch(t[k], v)
+	}
+	return t
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+func TestMergePatch(t *testing.T) {
+	// examples of the RFC 7396
+	tests := []struct {
+		target, patch, result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		var target, patch, expected interface{}
+		json.Unmarshal([]byte(tt.target), &target)
+		json.Unmarshal([]byte(tt.patch), &patch)
+		json.Unmarshal([]byte(tt.result), &expected)
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, expected) {
+			t.Errorf("patch %s on %s: expected %s got %v", tt.patch, tt.target, tt.result, got)
+		}
+	}
+}
+
+// TestPostWorkflowOfAnotherAccount post the id of the workflow of another account with the ETag of its latest version
+func TestPostWorkflowOfAnotherAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mt := newMemoryTransport()
+	h := newHandler(handlerConfig{WorkerName: "w0"}, db, mt)
+
+	graph := testGraph(t)
+	flow, err := json.Marshal(graph.Flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(dbWorkflow{ID: graph.ID, Name: graph.Name, Worker: h.workerName, Graph: flow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := uuid.Must(uuid.NewV4())
+
+	// the new version is only inserted when the id is not used by another account
+	mock.ExpectQuery(regexp.QuoteMeta("FROM workflow WHERE id = $2 AND account_id = $1")+`\s+HAVING .*`+
+		regexp.QuoteMeta("AND NOT EXISTS (SELECT 1 FROM workflow WHERE id = $2 AND account_id <> $1)")).
+		WithArgs(other, graph.ID, sqlmock.AnyArg(), h.workerName, graph.Name, "", sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"revision", "enabled"}))
+	mock.ExpectQuery("SELECT "+regexp.QuoteMeta(workflowColumns)).
+		WithArgs(other, graph.ID.String()).
+		WillReturnRows(sqlmock.NewRows(strings.Split(workflowColumns, ", ")))
+	mock.ExpectQuery(regexp.QuoteMeta("deleted_at IS NOT NULL")).
+		WithArgs(graph.ID, other).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	e := echo.New()
+	e.POST("/workflow", h.postWorkflow, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("account", auth.Account{ID: other})
+			return next(c)
+		}
+	})
+	req := httptest.NewRequest(http.MethodPost, "/workflow", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("If-Match", `"1"`)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("expected status %d got %d %s", http.StatusConflict, rec.Code, rec.Body)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if len(mt.commands) != 0 {
+		t.Error("the workflow of the other account should not be started")
+	}
+}
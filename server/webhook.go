@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+// maxWebhookRetryDelay is the maximum delay between two attempts of a webhook request
+const maxWebhookRetryDelay = time.Minute
+
+// webhookSnippetSize is the number of bytes of the response body kept in the delivery log
+const webhookSnippetSize = 512
+
+// webhookJob is an output message to send to a webhook
+type webhookJob struct {
+	id       uuid.UUID // the same on each attempt, sent as X-Webhook-Delivery
+	aid      uuid.UUID
+	wid      uuid.UUID
+	outputID string
+	url      string
+	body     []byte
+	span     trace.Span
+	attempts int
+	created  time.Time
+}
+
+// webhookDelivery is the result of a webhook request, once succeeded or given up
+type webhookDelivery struct {
+	ID       uuid.UUID `json:"id"`
+	AID      uuid.UUID `json:"-"`
+	WID      uuid.UUID `json:"-"`
+	OutputID string    `json:"output_id"`
+	URL      string    `json:"url"`
+	// Status is success, failure or dropped when the queue was full
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Attempts   int    `json:"attempts"`
+	// LatencyMS is the duration of the last attempt
+	LatencyMS  float64   `json:"latency_ms"`
+	Error      string    `json:"error,omitempty"`
+	Response   string    `json:"response,omitempty"` // the beginning of the response body
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// webhookDispatcher send the webhook requests with a bounded pool of workers.
+// The requests failing with a network error or a 5xx status are sent again with an exponential backoff.
+type webhookDispatcher struct {
+	client      *http.Client
+	queue       chan *webhookJob
+	maxAttempts int
+	retryDelay  time.Duration // the delay before the second attempt, doubled on each attempt
+	record      func(webhookDelivery)
+}
+
+// newWebhookDispatcher start workers sending the requests queued, at most queueSize requests wait for a worker.
+// Each attempt is cancelled after timeout, record is called with the result of each request if not nil.
+func newWebhookDispatcher(workers, queueSize int, timeout time.Duration, maxAttempts int, record func(webhookDelivery)) *webhookDispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	d := &webhookDispatcher{
+		client:      &http.Client{Timeout: timeout},
+		queue:       make(chan *webhookJob, queueSize),
+		maxAttempts: maxAttempts,
+		retryDelay:  time.Second,
+		record:      record,
+	}
+	for i := 0; i < workers; i++ {
+		go d.run()
+	}
+	return d
+}
+
+// send the output message of the workflow to the webhook url, s is the span of the delivery
+func (d *webhookDispatcher) send(aid, wid uuid.UUID, outputID, url string, body []byte, s trace.Span) {
+	if s == nil {
+		s = trace.SpanFromContext(context.Background())
+	}
+	d.enqueue(&webhookJob{
+		id:       uuid.Must(uuid.NewV4()),
+		aid:      aid,
+		wid:      wid,
+		outputID: outputID,
+		url:      url,
+		body:     body,
+		span:     s,
+		created:  time.Now(),
+	})
+}
+
+// enqueue the job, it is dropped if the queue is full
+func (d *webhookDispatcher) enqueue(job *webhookJob) {
+	select {
+	case d.queue <- job:
+	default:
+		log.Printf("webhook queue full, drop %v.%v to %s", job.aid, job.outputID, job.url)
+		d.finish(job, webhookDelivery{Status: "dropped", Error: "webhook queue full"})
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	for job := range d.queue {
+		d.attempt(job)
+	}
+}
+
+// attempt to send the request, it is scheduled again if it may succeed later
+func (d *webhookDispatcher) attempt(job *webhookJob) {
+	job.attempts++
+	result := webhookDelivery{Status: "failure"}
+	retry := false
+
+	req, err := http.NewRequest("POST", job.url, bytes.NewReader(job.body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Delivery", job.id.String())
+		req.Header.Set("X-Webhook-Attempt", strconv.Itoa(job.attempts))
+		propagator.Inject(trace.ContextWithSpan(req.Context(), job.span), propagation.HeaderCarrier(req.Header))
+		start := time.Now()
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err == nil {
+			snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, webhookSnippetSize))
+			resp.Body.Close()
+			result.StatusCode = resp.StatusCode
+			result.Response = responseSnippet(snippet)
+			switch {
+			case resp.StatusCode/100 == 2:
+				result.Status = "success"
+			case resp.StatusCode >= 500:
+				retry = true
+				err = fmt.Errorf("webhook returned %s", resp.Status)
+			default:
+				err = fmt.Errorf("webhook returned %s", resp.Status)
+			}
+		} else {
+			retry = true
+		}
+		result.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+		since(webhookDuration.WithLabelValues(job.aid.String(), job.wid.String()), start)
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+		if retry && job.attempts < d.maxAttempts {
+			delay := d.retryDelay << uint(job.attempts-1)
+			if delay > maxWebhookRetryDelay || delay <= 0 {
+				delay = maxWebhookRetryDelay
+			}
+			log.Printf("cannot send webhook %v.%v to %s, attempt %d retry in %v: %v", job.aid, job.outputID, job.url, job.attempts, delay, err)
+			time.AfterFunc(delay, func() { d.enqueue(job) })
+			return
+		}
+		log.Printf("cannot send webhook %v.%v to %s after %d attempts: %v", job.aid, job.outputID, job.url, job.attempts, err)
+	} else {
+		log.Printf("send webhook %v.%v to %s", job.aid, job.outputID, job.url)
+	}
+	d.finish(job, result)
+}
+
+// responseSnippet return the beginning of the response body as valid UTF-8 without NUL bytes,
+// to be stored as text. The rune cut by the size limit is dropped with the invalid bytes.
+func responseSnippet(body []byte) string {
+	var b strings.Builder
+	for len(body) > 0 {
+		r, size := utf8.DecodeRune(body)
+		if (r != utf8.RuneError || size > 1) && r != 0 {
+			b.Write(body[:size])
+		}
+		body = body[size:]
+	}
+	return b.String()
+}
+
+// finish the delivery of the job with its result
+func (d *webhookDispatcher) finish(job *webhookJob, result webhookDelivery) {
+	result.ID, result.AID, result.WID = job.id, job.aid, job.wid
+	result.OutputID, result.URL = job.outputID, job.url
+	result.Attempts = job.attempts
+	result.CreatedAt, result.FinishedAt = job.created, time.Now()
+
+	webhookRequests.WithLabelValues(job.aid.String(), job.wid.String(), result.Status).Inc()
+	job.span.SetAttributes(attribute.Int("webhook.attempts", job.attempts))
+	if result.StatusCode != 0 {
+		job.span.SetAttributes(attribute.Int("http.status_code", result.StatusCode))
+	}
+	if result.Status != "success" {
+		failSpan(job.span, fmt.Errorf("%s: %s", result.Status, result.Error))
+	}
+	job.span.End()
+
+	if d.record != nil {
+		d.record(result)
+	}
+}
+
+// webhookLog store the webhook deliveries in batch
+type webhookLog struct {
+	db         *sql.DB
+	deliveries chan webhookDelivery
+}
+
+func newWebhookLog(db *sql.DB) *webhookLog {
+	return &webhookLog{
+		db:         db,
+		deliveries: make(chan webhookDelivery, 4096),
+	}
+}
+
+// add the delivery to the log, it is dropped if the log is late
+func (wl *webhookLog) add(d webhookDelivery) {
+	select {
+	case wl.deliveries <- d:
+	default:
+		log.Printf("webhook log full, drop delivery %v of %v", d.ID, d.WID)
+	}
+}
+
+// run insert the deliveries by batch of at most 500 rows or every second
+func (wl *webhookLog) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	batch := make([]webhookDelivery, 0, 500)
+	for {
+		select {
+		case d := <-wl.deliveries:
+			batch = append(batch, d)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := wl.insert(batch); err != nil {
+			log.Printf("cannot insert %d webhook deliveries: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (wl *webhookLog) insert(batch []webhookDelivery) error {
+	const columns = 13
+	var query strings.Builder
+	query.WriteString(`INSERT INTO workflow_webhook_delivery (id, account_id, workflow_id, output_id, url, status, status_code,
+		attempts, latency_ms, error, response, created_at, finished_at) VALUES `)
+	args := make([]interface{}, 0, len(batch)*columns)
+	for i, d := range batch {
+		if i > 0 {
+			query.WriteString(",")
+		}
+		n := len(args)
+		query.WriteString("($" + strconv.Itoa(n+1))
+		for j := 2; j <= columns; j++ {
+			query.WriteString(",$" + strconv.Itoa(n+j))
+		}
+		query.WriteString(")")
+		args = append(args, d.ID, d.AID, d.WID, d.OutputID, d.URL, d.Status, d.StatusCode,
+			d.Attempts, d.LatencyMS, d.Error, d.Response, d.CreatedAt, d.FinishedAt)
+	}
+	_, err := wl.db.Exec(query.String(), args...)
+	return err
+}
+
+// webhookPurgeLock is the id of the postgres advisory lock taken by the worker purging the webhook deliveries
+const webhookPurgeLock = 0x776562686f6f6b73
+
+// purge hourly the deliveries older than the retention, a retention of 0 keep every delivery.
+// The workers purge one at a time.
+func (wl *webhookLog) purge(retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	for {
+		res, err := execLocked(wl.db, webhookPurgeLock, "DELETE FROM workflow_webhook_delivery WHERE created_at < $1;", time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("cannot purge the webhook deliveries: %v", err)
+		} else if res != nil {
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Printf("purge %d webhook deliveries older than %v", n, retention)
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// swagger:response webhookDeliveriesResponse
+type webhookDeliveriesResponse struct {
+	// in: body
+	Body []webhookDelivery
+}
+
+// swagger:route GET /workflow/{id}/webhooks/deliveries Workflow webhookDeliveries
+//
+// Webhook Deliveries
+//
+// Get the deliveries of the webhooks of the workflow, the latest first.
+// Query parameters: from and to (RFC3339, default the last 24 hours), status (success, failure or dropped),
+// limit (default 100, max 1000) and offset for the pagination.
+//
+//     Produces:
+//     - application/json
+//
+//     Schemes: http, https
+//
+//     Responses:
+//       200: webhookDeliveriesResponse
+//       400:
+//       500:
+func (h *handler) getWebhookDeliveries(c echo.Context) error {
+	// Auth
+	account := c.Get("account").(auth.Account)
+	wid, err := uuid.FromString(c.Param("wid"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": err.Error()})
+	}
+
+	badRequest := func(msg string) error {
+		return c.JSON(http.StatusBadRequest, map[string]string{"message": msg})
+	}
+	to := time.Now()
+	if s := c.QueryParam("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return badRequest("invalid to: " + err.Error())
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := c.QueryParam("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return badRequest("invalid from: " + err.Error())
+		}
+	}
+	limit := 100
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > 1000 {
+			return badRequest("invalid limit")
+		}
+	}
+	offset := 0
+	if s := c.QueryParam("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return badRequest("invalid offset")
+		}
+	}
+	status := c.QueryParam("status")
+	if status != "" && status != "success" && status != "failure" && status != "dropped" {
+		return badRequest("invalid status, expect success, failure or dropped")
+	}
+
+	query := `SELECT id, output_id, url, status, status_code, attempts, latency_ms, error, response, created_at, finished_at
+	FROM workflow_webhook_delivery
+	WHERE account_id = $1 AND workflow_id = $2 AND created_at >= $3 AND created_at <= $4 AND ($5 = '' OR status = $5)
+	ORDER BY created_at DESC
+	LIMIT $6 OFFSET $7;`
+	rows, err := h.db.Query(query, account.ID, wid, from, to, status, limit, offset)
+	if err != nil {
+		c.Logger().Errorf("cannot find webhook deliveries for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer rows.Close()
+
+	deliveries := make([]webhookDelivery, 0, 64)
+	for rows.Next() {
+		var d webhookDelivery
+		err := rows.Scan(&d.ID, &d.OutputID, &d.URL, &d.Status, &d.StatusCode, &d.Attempts, &d.LatencyMS,
+			&d.Error, &d.Response, &d.CreatedAt, &d.FinishedAt)
+		if err != nil {
+			c.Logger().Errorf("cannot scan webhook deliveries for %v.%v: %v", account.ID, wid, err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		c.Logger().Errorf("cannot find webhook deliveries for %v.%v: %v", account.ID, wid, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/labstack/echo"
+
+	auth "github.com/fredericalix/yic_auth"
+)
+
+func TestWebhookDispatcher(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			// fail twice before accepting the delivery
+			if n <= 2 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.Error(w, "unknown hook", http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	deliveries := make(chan webhookDelivery, 8)
+	d := newWebhookDispatcher(2, 8, 100*time.Millisecond, 3, func(d webhookDelivery) { deliveries <- d })
+	d.retryDelay = 10 * time.Millisecond
+	aid, wid := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+	next := func() webhookDelivery {
+		select {
+		case delivery := <-deliveries:
+			return delivery
+		case <-time.After(5 * time.Second):
+			t.Fatal("no delivery")
+		}
+		return webhookDelivery{}
+	}
+
+	// the 5xx are retried until success
+	d.send(aid, wid, "out", server.URL+"/flaky", []byte(`{}`), nil)
+	if r := next(); r.Status != "success" || r.Attempts != 3 || r.StatusCode != 200 || r.Response != "ok" || r.WID != wid {
+		t.Errorf("wrong flaky delivery %+v", r)
+	}
+
+	// the 4xx are not retried
+	atomic.StoreInt32(&calls, 0)
+	d.send(aid, wid, "out", server.URL+"/unknown", []byte(`{}`), nil)
+	if r := next(); r.Status != "failure" || r.Attempts != 1 || r.StatusCode != 404 || r.Response != "unknown hook\n" {
+		t.Errorf("wrong unknown delivery %+v", r)
+	}
+
+	// the timeouts are retried until the maximum attempts
+	d.send(aid, wid, "out", server.URL+"/slow", []byte(`{}`), nil)
+	if r := next(); r.Status != "failure" || r.Attempts != 3 || r.Error == "" {
+		t.Errorf("wrong slow delivery %+v", r)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	deliveries := make(chan webhookDelivery, 1)
+	// no worker consume the queue
+	d := &webhookDispatcher{queue: make(chan *webhookJob), record: func(d webhookDelivery) { deliveries <- d }}
+	d.send(uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), "out", "http://localhost", []byte(`{}`), nil)
+	if r := <-deliveries; r.Status != "dropped" || r.Attempts != 0 {
+		t.Errorf("the delivery should be dropped, got %+v", r)
+	}
+}
+
+func TestResponseSnippet(t *testing.T) {
+	for body, expected := range map[string]string{
+		"ok":                 "ok",
+		"caf\xc3\xa9":        "caf\u00e9",
+		"a\x00b":             "ab",
+		"bad \xff\xfe bytes": "bad  bytes",
+		"cut \xe2\x82":       "cut ",
+		"\ufffd kept":        "\ufffd kept",
+	} {
+		if got := responseSnippet([]byte(body)); got != expected {
+			t.Errorf("%q: expected %q got %q", body, expected, got)
+		}
+	}
+}
+
+func TestWebhookDeliveriesRoute(t *testing.T) {
+	// the deliveries route is resolved among the other routes of the workflows
+	wid := uuid.Must(uuid.NewV4())
+	h := &handler{}
+	e := echo.New()
+	e.GET("/workflow/:wid", func(c echo.Context) error { return nil })
+	e.GET("/workflow/:wid/versions", func(c echo.Context) error { return nil })
+	e.GET("/workflow/:wid/webhooks/deliveries", h.getWebhookDeliveries, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("account", auth.Account{})
+			if c.Param("wid") != wid.String() {
+				t.Errorf("wrong id %q", c.Param("wid"))
+			}
+			return next(c)
+		}
+	})
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/workflow/"+wid.String()+"/webhooks/deliveries?status=unknown", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "invalid status") {
+		t.Errorf("expected the status to be checked after the id, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,130 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SimulationMessage is a timestamped sensor message to feed a graph in Simulate
+type SimulationMessage struct {
+	SensorID  string                 `json:"sensor_id"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// SimulationStep is the state of the graph after one SimulationMessage
+type SimulationStep struct {
+	SensorID  string    `json:"sensor_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Accepted is the list of the input node keys updated by the message
+	Accepted   []string `json:"accepted"`
+	Recomputed bool     `json:"recomputed"`
+	Error      string   `json:"error,omitempty"`
+
+	// Values of every node by its key
+	Values   map[string]Value                  `json:"values"`
+	Outputs  map[string]map[string]interface{} `json:"outputs,omitempty"`
+	Webhooks []SimulatedWebhook                `json:"webhooks,omitempty"`
+}
+
+// SimulatedWebhook is a webhook which would have been sent
+type SimulatedWebhook struct {
+	SensorID string                 `json:"sensor_id"`
+	URL      string                 `json:"url"`
+	Body     map[string]interface{} `json:"body"`
+}
+
+// Simulate feed the messages in order to the graph and return the result of each step.
+// Nothing is sent, the output messages and webhooks are only reported.
+// The graph is built if needed and keep its state after the simulation.
+func Simulate(g *FlowGraph, msgs []SimulationMessage) ([]SimulationStep, error) {
+	if g.Inputs == nil {
+		if err := g.Build(); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make(map[*FlowNode]string, len(g.Flow))
+	for key, node := range g.Flow {
+		keys[node] = key
+	}
+
+	steps := make([]SimulationStep, 0, len(msgs))
+	for _, msg := range msgs {
+		step := SimulationStep{
+			SensorID:  msg.SensorID,
+			CreatedAt: msg.CreatedAt,
+			Accepted:  []string{},
+		}
+		if step.CreatedAt.IsZero() {
+			// fallback on the field of the sensor message
+			createdAt, _ := msg.Data["created_at"].(string)
+			t, err := time.Parse(time.RFC3339Nano, createdAt)
+			if err != nil {
+				step.Error = fmt.Sprintf("missing created_at in message: %v", err)
+				step.Values = g.values(keys)
+				steps = append(steps, step)
+				continue
+			}
+			step.CreatedAt = t
+		}
+
+		rev := g.rev
+		recompute, err := g.SendInput(g.AID.String(), msg.SensorID, step.CreatedAt, msg.Data)
+		if err != nil {
+			step.Error = err.Error()
+		}
+		if g.rev != rev {
+			for _, node := range g.Inputs[msg.SensorID] {
+				if node.rev == g.rev {
+					step.Accepted = append(step.Accepted, keys[node])
+				}
+			}
+			sort.Strings(step.Accepted)
+		}
+
+		if err == nil && recompute {
+			if err := g.safeCompute(); err != nil {
+				step.Error = err.Error()
+			} else {
+				step.Recomputed = true
+				now := step.CreatedAt.Format(time.RFC3339Nano)
+				step.Outputs = g.OutputMessages()
+				for sid, out := range step.Outputs {
+					out["created_at"] = now
+					if url, exist := g.Hooks[sid]; exist {
+						step.Webhooks = append(step.Webhooks, SimulatedWebhook{SensorID: sid, URL: url, Body: out})
+					}
+				}
+				sort.Slice(step.Webhooks, func(i, j int) bool { return step.Webhooks[i].SensorID < step.Webhooks[j].SensorID })
+			}
+		}
+
+		step.Values = g.values(keys)
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// safeCompute is Compute which return the operator panic as an error
+func (g *FlowGraph) safeCompute() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("compute: %v", r)
+		}
+	}()
+	g.Compute()
+	return nil
+}
+
+func (g *FlowGraph) values(keys map[*FlowNode]string) map[string]Value {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	values := make(map[string]Value, len(keys))
+	for node, key := range keys {
+		values[key] = node.ComputedValue
+	}
+	return values
+}
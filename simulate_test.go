@@ -0,0 +1,79 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid := "1377959e-97ce-46c1-9715-22c34bb9afbe"
+	steps, err := Simulate(&graph, []SimulationMessage{
+		{SensorID: sid, CreatedAt: time.Unix(1, 0), Data: map[string]interface{}{"ramusage": 1.0, "loadaverage": 0.2, "ram": 4.0}},
+		{SensorID: sid, CreatedAt: time.Unix(2, 0), Data: map[string]interface{}{"loadaverage": 0.9}},
+		{SensorID: sid, CreatedAt: time.Unix(1, 0), Data: map[string]interface{}{"loadaverage": 0.0}},
+		{SensorID: "unknown", CreatedAt: time.Unix(3, 0), Data: map[string]interface{}{"loadaverage": 0.0}},
+		{SensorID: sid, Data: map[string]interface{}{"created_at": time.Unix(4, 0).Format(time.RFC3339Nano), "ram": "four"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 5 {
+		t.Fatalf("expected 5 steps, got %d", len(steps))
+	}
+
+	// first message set every input and send both outputs with the webhook
+	s := steps[0]
+	if len(s.Accepted) != 3 || !s.Recomputed {
+		t.Errorf("step 0: expected 3 accepted inputs and a recompute, got %v %v", s.Accepted, s.Recomputed)
+	}
+	out, exist := s.Outputs["1949f63d-5e40-45bb-9d31-13ab52b5e92a"]
+	if !exist {
+		t.Fatalf("step 0: missing output message: %v", s.Outputs)
+	}
+	if out["windmill_onfire"] != false || out["windmill_propeler_speed"] != "slow" {
+		t.Errorf("step 0: wrong output message %v", out)
+	}
+	if len(s.Webhooks) != 1 || s.Webhooks[0].URL != "http://localhost:2030" {
+		t.Errorf("step 0: expected the webhook, got %v", s.Webhooks)
+	}
+	if s.Values["op_ram"] != 0.25 {
+		t.Errorf("step 0: wrong intermediate value op_ram=%v", s.Values["op_ram"])
+	}
+
+	// second message only change the load average, the windmill is on fire
+	s = steps[1]
+	if len(s.Accepted) != 1 || s.Accepted[0] != "input1" {
+		t.Errorf("step 1: expected input1 accepted, got %v", s.Accepted)
+	}
+	if s.Outputs["1949f63d-5e40-45bb-9d31-13ab52b5e92a"]["windmill_onfire"] != true {
+		t.Errorf("step 1: wrong output message %v", s.Outputs)
+	}
+
+	// older message is ignored
+	s = steps[2]
+	if len(s.Accepted) != 0 || s.Recomputed || len(s.Outputs) != 0 {
+		t.Errorf("step 2: older message must be ignored, got %+v", s)
+	}
+
+	// unknown sensor is ignored
+	s = steps[3]
+	if len(s.Accepted) != 0 || s.Recomputed {
+		t.Errorf("step 3: unknown sensor must be ignored, got %+v", s)
+	}
+
+	// wrong type is reported
+	s = steps[4]
+	if s.Error == "" || s.Recomputed {
+		t.Errorf("step 4: expected an error, got %+v", s)
+	}
+	if !s.CreatedAt.Equal(time.Unix(4, 0)) {
+		t.Errorf("step 4: created_at not taken from the message: %v", s.CreatedAt)
+	}
+}
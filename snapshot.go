@@ -0,0 +1,77 @@
+package workflow
+
+import "time"
+
+// Snapshot is the runtime state of a FlowGraph, it can be serialized in json
+type Snapshot struct {
+	Rev   uint64               `json:"rev"`
+	Nodes map[string]NodeState `json:"nodes"`
+}
+
+// NodeState is the runtime state of a node
+type NodeState struct {
+	Operator    string    `json:"operator"`
+	Type        string    `json:"type,omitempty"`
+	Value       Value     `json:"value"`
+	Rev         uint64    `json:"rev"`
+	Changed     bool      `json:"changed,omitempty"`
+	LastChanged time.Time `json:"last_changed,omitempty"`
+}
+
+// Snapshot return a consistent copy of the runtime state of the graph.
+// It is safe to call while the graph is computed.
+func (g *FlowGraph) Snapshot() Snapshot {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	s := Snapshot{
+		Rev:   g.rev,
+		Nodes: make(map[string]NodeState, len(g.Flow)),
+	}
+	for key, node := range g.Flow {
+		s.Nodes[key] = NodeState{
+			Operator:    node.Operator,
+			Type:        node.Type,
+			Value:       node.ComputedValue,
+			Rev:         node.rev,
+			Changed:     node.changed,
+			LastChanged: node.lastChanged,
+		}
+	}
+	return s
+}
+
+// Restore the runtime state of the graph from a snapshot, the graph is built if needed.
+// Only the nodes with the same key, operator and type are restored, constants keep their value.
+// It return the number of restored nodes.
+func (g *FlowGraph) Restore(s Snapshot) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.Inputs == nil {
+		if err := g.build(); err != nil {
+			return 0, err
+		}
+	}
+	if s.Rev > g.rev {
+		g.rev = s.Rev
+	}
+	g.computedRev = g.rev
+
+	restored := 0
+	for key, state := range s.Nodes {
+		node, exist := g.Flow[key]
+		if !exist || node.Operator == "const" || node.Operator != state.Operator || node.Type != state.Type {
+			continue
+		}
+		if state.Value != nil {
+			node.ComputedValue = state.Value
+		}
+		node.prevValue = node.ComputedValue
+		node.lastChanged = state.LastChanged
+		node.changed = false
+		if state.Rev < g.computedRev {
+			node.rev = state.Rev
+		}
+		restored++
+	}
+	return restored, nil
+}
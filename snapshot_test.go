@@ -0,0 +1,108 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = graph.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sid := "1377959e-97ce-46c1-9715-22c34bb9afbe"
+	data := map[string]interface{}{"ramusage": 1.0, "loadaverage": 0.9, "ram": 4.0}
+	_, err = graph.SendInput("", sid, time.Unix(1, 0), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Compute()
+
+	// the snapshot survive a json round trip
+	raw, err := json.Marshal(graph.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s Snapshot
+	err = json.Unmarshal(raw, &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := graph.Clone()
+	n, err := restored.Restore(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(graph.Flow)-1 {
+		t.Errorf("expected every node but the constant restored, got %d", n)
+	}
+
+	// an older message is still ignored
+	recompute, err := restored.SendInput("", sid, time.Unix(1, 0), map[string]interface{}{"loadaverage": 0.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recompute {
+		t.Error("older message accepted after restore")
+	}
+
+	// the same values must not change the outputs
+	recompute, err = restored.SendInput("", sid, time.Unix(2, 0), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !recompute {
+		t.Fatal("newer message not accepted after restore")
+	}
+	restored.Compute()
+	if msgs := restored.OutputMessages(); len(msgs) != 0 {
+		t.Errorf("spurious output change after restore: %v", msgs)
+	}
+}
+
+func TestRestoreNewVersion(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = graph.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = graph.SendInput("", "1377959e-97ce-46c1-9715-22c34bb9afbe", time.Unix(1, 0), map[string]interface{}{"ramusage": 1.0, "loadaverage": 0.9, "ram": 4.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	graph.Compute()
+
+	// new version: input0 change of type and input1 is removed
+	next := graph.Clone()
+	next.Flow["input0"].Type = "string"
+	next.Flow["input3"] = next.Flow["input1"]
+	delete(next.Flow, "input1")
+	next.Flow["op1"].Inputs = []string{"input3", "const0"}
+	next.Flow["op4"].Inputs = []string{"op_ram", "input3"}
+
+	_, err = next.Restore(graph.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Flow["input0"].ComputedValue != "" {
+		t.Errorf("input0 of another type must not be restored, got %v", next.Flow["input0"].ComputedValue)
+	}
+	if next.Flow["input3"].ComputedValue != 0.0 {
+		t.Errorf("new input3 must not be restored, got %v", next.Flow["input3"].ComputedValue)
+	}
+	if next.Flow["input2"].ComputedValue != 4.0 || next.Flow["output0"].ComputedValue != true {
+		t.Errorf("matching nodes must be restored, got %v %v", next.Flow["input2"].ComputedValue, next.Flow["output0"].ComputedValue)
+	}
+}
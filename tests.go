@@ -0,0 +1,110 @@
+package workflow
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// TestCase check the outputs of a graph after the given input messages
+type TestCase struct {
+	Name string `json:"name"`
+	// Given sensor messages, in order, fed to the graph.
+	// When created_at is missing the messages are dated one second apart.
+	Given []SimulationMessage `json:"given"`
+	// Expect the output values by sensor id and field name
+	Expect map[string]map[string]interface{} `json:"expect"`
+}
+
+// TestResult of a TestCase
+type TestResult struct {
+	Name     string   `json:"name"`
+	Passed   bool     `json:"passed"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// RunTests run every test case on a fresh copy of the graph
+func RunTests(g *FlowGraph, tests []TestCase) []TestResult {
+	results := make([]TestResult, 0, len(tests))
+	for i, test := range tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i)
+		}
+		result := TestResult{Name: name}
+		result.Failures = runTest(g.Clone(), test)
+		result.Passed = len(result.Failures) == 0
+		results = append(results, result)
+	}
+	return results
+}
+
+// TestsPassed return true if every result passed
+func TestsPassed(results []TestResult) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func runTest(g *FlowGraph, test TestCase) (failures []string) {
+	msgs := make([]SimulationMessage, len(test.Given))
+	copy(msgs, test.Given)
+	for i := range msgs {
+		if msgs[i].CreatedAt.IsZero() {
+			msgs[i].CreatedAt = time.Unix(int64(i+1), 0)
+		}
+	}
+
+	steps, err := Simulate(g, msgs)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	for i, step := range steps {
+		if step.Error != "" {
+			failures = append(failures, fmt.Sprintf("given %d: %s", i, step.Error))
+		}
+	}
+
+	outputs := make(map[string]map[string]*FlowNode)
+	for _, out := range g.Outputs {
+		fields, exist := outputs[out.ID]
+		if !exist {
+			fields = make(map[string]*FlowNode)
+			outputs[out.ID] = fields
+		}
+		fields[out.Name] = out
+	}
+
+	for sid, fields := range test.Expect {
+		for name, want := range fields {
+			out, exist := outputs[sid][name]
+			if !exist {
+				failures = append(failures, fmt.Sprintf("unknown output %s.%s", sid, name))
+				continue
+			}
+			if !sameValue(out.ComputedValue, want) {
+				failures = append(failures, fmt.Sprintf("output %s.%s: expected %v, got %v", sid, name, want, out.ComputedValue))
+			}
+		}
+	}
+	sort.Strings(failures)
+	return failures
+}
+
+// sameValue compare a computed value with an expected value decoded from json
+func sameValue(got, want Value) bool {
+	if g, ok := got.(float64); ok {
+		switch w := want.(type) {
+		case float64:
+			return math.Abs(g-w) < 1.0e-9
+		case int:
+			return math.Abs(g-float64(w)) < 1.0e-9
+		}
+		return false
+	}
+	return got == want
+}
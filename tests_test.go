@@ -0,0 +1,68 @@
+package workflow
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestRunTests(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests []TestCase
+	err = json.Unmarshal([]byte(`[
+	{
+		"name": "low load",
+		"given": [
+			{"sensor_id": "1377959e-97ce-46c1-9715-22c34bb9afbe", "data": {"ramusage": 1.0, "loadaverage": 0.2, "ram": 4.0}}
+		],
+		"expect": {
+			"1949f63d-5e40-45bb-9d31-13ab52b5e92a": {"windmill_onfire": false, "windmill_propeler_speed": "slow"}
+		}
+	},
+	{
+		"name": "on fire",
+		"given": [
+			{"sensor_id": "1377959e-97ce-46c1-9715-22c34bb9afbe", "data": {"ramusage": 1.0, "loadaverage": 0.2, "ram": 4.0}},
+			{"sensor_id": "1377959e-97ce-46c1-9715-22c34bb9afbe", "data": {"loadaverage": 0.9}}
+		],
+		"expect": {
+			"1949f63d-5e40-45bb-9d31-13ab52b5e92a": {"windmill_onfire": true, "windmill_propeler_speed": "fast"}
+		}
+	},
+	{
+		"name": "wrong",
+		"given": [
+			{"sensor_id": "1377959e-97ce-46c1-9715-22c34bb9afbe", "data": {"ramusage": 1.0, "loadaverage": 0.2, "ram": 4.0}}
+		],
+		"expect": {
+			"1949f63d-5e40-45bb-9d31-13ab52b5e92a": {"windmill_onfire": true, "unknown": 1}
+		}
+	}
+]`), &tests)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := RunTests(&graph, tests)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if !results[0].Passed || !results[1].Passed {
+		t.Errorf("expected passing tests, got %+v", results[:2])
+	}
+	if results[2].Passed || len(results[2].Failures) != 2 {
+		t.Errorf("expected 2 failures, got %+v", results[2])
+	}
+	if TestsPassed(results) {
+		t.Error("TestsPassed must be false")
+	}
+
+	// the tests must not modify the graph
+	if graph.Inputs != nil {
+		t.Error("the tested graph has been built")
+	}
+}
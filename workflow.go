@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
@@ -325,7 +326,13 @@ type FlowGraph struct {
 	Nodes   []*FlowNode
 	Hooks   map[string]string
 
-	rev uint64
+	rev         uint64
+	computedRev uint64 // rev of the last Compute
+
+	// mu protect the runtime state of the nodes,
+	// SendInput and Compute can be called while the state is read with Snapshot, Explain or WriteDotFormat
+	mu           sync.RWMutex
+	explanations map[string]Explanation // by output node key
 }
 
 // FlowNode in the FlowGraph used to parsed json graph
@@ -338,9 +345,11 @@ type FlowNode struct {
 	Values    []string
 	Condition []string
 
-	rev     uint64
-	changed bool
+	key         string
+	rev         uint64
+	changed     bool
 	lastChanged time.Time
+	prevValue   Value // value before the last change
 
 	ComputedValue  Value
 	ComputedInputs []*Value
@@ -349,8 +358,10 @@ type FlowNode struct {
 
 // SendInput to the graph before Compute
 func (g *FlowGraph) SendInput(aid, sid string, createdAt time.Time, data map[string]interface{}) (mustRecompute bool, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	if g.Inputs == nil {
-		g.Build()
+		g.build()
 	}
 	input, wanted := g.Inputs[sid]
 	if !wanted {
@@ -360,7 +371,7 @@ func (g *FlowGraph) SendInput(aid, sid string, createdAt time.Time, data map[str
 	for name, value := range data {
 		if node, wanted := input[name]; wanted {
 			// don't update if the received message is older than the last one we see
-			if createdAt.Before(node.lastChanged) || createdAt == node.lastChanged {
+			if !createdAt.After(node.lastChanged) {
 				continue
 			}
 			switch node.Type {
@@ -399,6 +410,10 @@ func (g *FlowGraph) SendInput(aid, sid string, createdAt time.Time, data map[str
 					return false, fmt.Errorf("in node '%s' input wanted string, got %T", name, value)
 				}
 			}
+			// keep the value seen by the last Compute
+			if node.rev <= g.computedRev {
+				node.prevValue = node.ComputedValue
+			}
 			node.ComputedValue = value
 			node.lastChanged = createdAt
 			node.rev = g.rev
@@ -410,8 +425,10 @@ func (g *FlowGraph) SendInput(aid, sid string, createdAt time.Time, data map[str
 
 // WantInput return true if we need to use this message
 func (g *FlowGraph) WantInput(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	if g.Inputs == nil {
-		g.Build()
+		g.build()
 	}
 	_, wanted := g.Inputs[id]
 	return wanted
@@ -419,9 +436,16 @@ func (g *FlowGraph) WantInput(id string) bool {
 
 // Build internal helper graph from basic json graph
 func (g *FlowGraph) Build() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.build()
+}
+
+func (g *FlowGraph) build() error {
 	g.Inputs = make(map[string]map[string]*FlowNode)
 	g.Hooks = make(map[string]string)
 	for nodeKey, node := range g.Flow {
+		node.key = nodeKey
 		if (node.Operator == "input" || node.Operator == "output" || node.Operator == "webhook") && node.ID == "" {
 			return fmt.Errorf("missing id in node '%s'", nodeKey)
 		}
@@ -491,6 +515,7 @@ func (g *FlowGraph) Build() error {
 	// Order the Nodes DAG to compute the Operation of each node sequentialy
 	g.Nodes = make([]*FlowNode, 0, len(g.Flow))
 	for len(g.Nodes) < len(g.Flow) {
+		placed := len(g.Nodes)
 		for _, node := range g.Flow {
 			// Use rev to indicate if the node is already placed in the Nodes list
 			if node.rev != 0 {
@@ -509,16 +534,57 @@ func (g *FlowGraph) Build() error {
 				g.Nodes = append(g.Nodes, node)
 			}
 		}
+		// nothing can be placed anymore, the remaining nodes are in a cycle
+		if placed == len(g.Nodes) {
+			return fmt.Errorf("cycle detected in the graph")
+		}
 	}
+	g.rev = 1
+	g.computedRev = g.rev
 
 	return nil
 }
 
+// Clone return a copy of the graph definition without the computed state.
+// The copy must be built before use.
+func (g *FlowGraph) Clone() *FlowGraph {
+	c := &FlowGraph{
+		ID:   g.ID,
+		AID:  g.AID,
+		Name: g.Name,
+		Flow: make(map[string]*FlowNode, len(g.Flow)),
+	}
+	for key, node := range g.Flow {
+		n := &FlowNode{
+			ID:        node.ID,
+			Name:      node.Name,
+			Type:      node.Type,
+			Operator:  node.Operator,
+			Inputs:    append([]string(nil), node.Inputs...),
+			Values:    append([]string(nil), node.Values...),
+			Condition: append([]string(nil), node.Condition...),
+		}
+		// the value of a constant is part of the definition
+		if node.Operator == "const" {
+			n.ComputedValue = node.ComputedValue
+		}
+		c.Flow[key] = n
+	}
+	return c
+}
+
 // Compute don't check anything, the graph MUST be check before called
 func (g *FlowGraph) Compute() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for _, node := range g.Nodes {
+		if node.Operator == "output" {
+			node.prevValue = node.ComputedValue
+		}
 		node.Operation.Fn(node)
 	}
+	g.explain()
+	g.computedRev = g.rev
 }
 
 // Output after the Compute to get the result
@@ -526,8 +592,41 @@ func (g *FlowGraph) Output() []*FlowNode {
 	return g.Outputs
 }
 
+// OutputMessages group the outputs by sensor id after the Compute.
+// Only the sensors with at least one changed field are returned, with every field of the sensor.
+func (g *FlowGraph) OutputMessages() map[string]map[string]interface{} {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	// make a set of message id where at least one of its field has changed
+	changed := make(map[string]struct{})
+	for _, out := range g.Outputs {
+		if out.HasChanged() {
+			changed[out.ID] = struct{}{}
+		}
+	}
+	output := make(map[string]map[string]interface{})
+	for _, out := range g.Outputs {
+		// only contruct message if its in the changed set of message id
+		if _, mustSend := changed[out.ID]; !mustSend {
+			continue
+		}
+		v, exist := output[out.ID]
+		if !exist {
+			// construct the message
+			v = make(map[string]interface{})
+			v["id"] = out.ID
+			output[out.ID] = v
+		}
+		// append the field to the message
+		v[out.Name] = out.ComputedValue
+	}
+	return output
+}
+
 // WriteDotFormat to visualize the graphflow
 func (g *FlowGraph) WriteDotFormat(w io.Writer) (n int, err error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
 	fmt.Fprintf(w, "digraph \"%v %s\" {\n", g.ID, g.Name)
 	fmt.Fprint(w, " {\n")
 	for k, node := range g.Flow {
@@ -3,6 +3,8 @@ package workflow
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"sync"
 	"testing"
 	"time"
 )
@@ -242,6 +244,97 @@ func TestInputsLen(t *testing.T) {
 	}
 }
 
+func TestCycle(t *testing.T) {
+	raw := `{
+	"name": "cycle",
+	"id": "3e8c8cc8-7567-4594-a8d0-c38d9f64765e",
+	"account_id": "fe8927e9-a02a-416a-8928-c3a86dae4c61",
+	"flow": {
+		"in": {
+			"operator": "input",
+			"type": "bool",
+			"name": "status",
+			"id": "001"
+		},
+		"op0": {
+			"operator": "and",
+			"inputs": ["in", "op1"]
+		},
+		"op1": {
+			"operator": "not",
+			"inputs": ["op0"]
+		}
+	}
+}`
+
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(raw), &graph)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = graph.Build()
+	if err == nil {
+		t.Error("cycle is not catch")
+	}
+}
+
+// TestConcurrentReaders must be run with the race detector
+func TestConcurrentReaders(t *testing.T) {
+	var graph FlowGraph
+	err := json.Unmarshal([]byte(_rawgraph), &graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = graph.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				s := graph.Snapshot()
+				if len(s.Nodes) != len(graph.Flow) {
+					t.Errorf("incomplete snapshot: %d nodes", len(s.Nodes))
+				}
+				graph.Explain("output0")
+				graph.OutputExplanations("1949f63d-5e40-45bb-9d31-13ab52b5e92a")
+				graph.WriteDotFormat(ioutil.Discard)
+			}
+		}()
+	}
+
+	rams := []float64{0.01, 0.2, 0.4, 0.6, 0.8, 0.9, 1.0, 1.6, 2.0, 2.5, 3.0, 3.3, 3.5, 3.8, 4.0}
+	for i := 0; i < 2000; i++ {
+		_, err := graph.SendInput("fe8927e9-a02a-416a-8928-c3a86dae4c61", "1377959e-97ce-46c1-9715-22c34bb9afbe", time.Unix(int64(i+1), 0), map[string]interface{}{
+			"ramusage":    rams[i%len(rams)],
+			"loadaverage": rams[(i+3)%len(rams)] / 4,
+			"ram":         4.0,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph.Compute()
+		graph.OutputMessages()
+	}
+	close(done)
+	wg.Wait()
+
+	if s := graph.Snapshot(); s.Rev != 2001 {
+		t.Errorf("expected rev 2001, got %d", s.Rev)
+	}
+}
+
 func BenchmarkSameInput(b *testing.B) {
 	var graph FlowGraph
 	err := json.Unmarshal([]byte(_rawgraph), &graph)